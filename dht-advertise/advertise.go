@@ -0,0 +1,153 @@
+// Package advertise tracks the addresses a node gives to its peers, learning
+// them from the peers when the node listens on all interfaces. It is shared
+// by dht-node and dht-network.
+package advertise
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+
+	"dht-multiaddr"
+)
+
+// observationQuorum is how many peers must report the same address before
+// the node switches to it. With fewer peers, all of them must agree.
+const observationQuorum = 2
+
+// Addresses holds the addresses a node gives to peers. They are fixed by
+// --advertise-addr or by listening on a specific host. A node listening on
+// all interfaces starts with 127.0.0.1 and switches to the address its peers
+// see its requests coming from, once enough of them agree.
+type Addresses struct {
+	port  int // listen port, combined with observed hosts
+	fixed bool
+
+	mu       sync.RWMutex
+	addrs    []multiaddr.Addr  // first one is the primary address
+	observed map[string]string // peer node ID -> our address (host:port) as seen by that peer
+	changed  chan struct{}
+}
+
+// New returns the advertised addresses for a node listening on listenAddr.
+// A non-empty advertise list (host:port or multiaddr-style) is used as given.
+func New(listenAddr string, advertise []string) (*Addresses, error) {
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen address %q: %w", listenAddr, err)
+	}
+	port, err := multiaddr.ParsePort(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("listen address %q: %w", listenAddr, err)
+	}
+	a := &Addresses{port: port, observed: make(map[string]string), changed: make(chan struct{}, 1)}
+	switch {
+	case len(advertise) > 0:
+		for _, s := range advertise {
+			addr, err := multiaddr.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			a.addrs = append(a.addrs, addr)
+		}
+		a.fixed = true
+	case host == "" || net.ParseIP(host).IsUnspecified():
+		a.addrs = []multiaddr.Addr{{Transport: "tcp", IPVersion: 4, Host: "127.0.0.1", Port: port}}
+	default:
+		addr, err := multiaddr.Parse(listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		a.addrs, a.fixed = []multiaddr.Addr{addr}, true
+	}
+	return a, nil
+}
+
+// Primary returns the host:port peers should use by default.
+func (a *Addresses) Primary() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.addrs[0].HostPort()
+}
+
+// All returns every advertised address, primary first.
+func (a *Addresses) All() []multiaddr.Addr {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.addrs)
+}
+
+// Has reports whether hostPort is one of the advertised addresses.
+func (a *Addresses) Has(hostPort string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Contains(multiaddr.HostPorts(a.addrs), hostPort)
+}
+
+// Fixed reports whether the addresses were given rather than learned from
+// peers, so they stay the same across restarts.
+func (a *Addresses) Fixed() bool {
+	return a.fixed
+}
+
+// Changed is signalled whenever the advertised addresses change.
+func (a *Addresses) Changed() <-chan struct{} {
+	return a.changed
+}
+
+// Observations returns how many peers currently report each address.
+func (a *Addresses) Observations() map[string]int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, addr := range a.observed {
+		counts[addr]++
+	}
+	return counts
+}
+
+// Observe records that the peer with peerID saw a request from this node
+// coming from remote (host:port). Only the host is used; outgoing requests
+// come from ephemeral ports, so it is combined with the listen port.
+// Loopback observations are ignored: they only show that the peer runs on the
+// same host, and the node already starts out advertising 127.0.0.1. The
+// primary address switches to the address most peers report, once at least
+// observationQuorum of them (or all, if fewer have reported) agree.
+func (a *Addresses) Observe(peerID, remote string) {
+	host, _, err := net.SplitHostPort(remote)
+	if a.fixed || peerID == "" || err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(a.port))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.observed[peerID] = addr
+	counts := make(map[string]int)
+	for _, o := range a.observed {
+		counts[o]++
+	}
+	best := a.addrs[0].HostPort()
+	for o, n := range counts {
+		if n > counts[best] {
+			best = o
+		}
+	}
+	if best == a.addrs[0].HostPort() || counts[best] < min(observationQuorum, len(a.observed)) {
+		return
+	}
+	slog.Info("advertised address changed", "from", a.addrs[0], "to", best, "observers", counts[best])
+	bestAddr, _ := multiaddr.Parse(best) // built by JoinHostPort above
+	a.addrs = []multiaddr.Addr{bestAddr}
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,7 @@
+module dht-advertise
+
+go 1.24.3
+
+require dht-multiaddr v0.0.0
+
+replace dht-multiaddr => ../dht-multiaddr
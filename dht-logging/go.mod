@@ -0,0 +1,3 @@
+module dht-logging
+
+go 1.24.3
@@ -0,0 +1,81 @@
+// Package logging sets up log/slog and carries request IDs through HTTP
+// handlers and outbound calls. It only uses the standard library and is
+// shared by dht-node, dht-network and dht-server.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RequestIDHeader carries the request ID between clients and nodes so one
+// request can be followed across hops in the logs of several nodes.
+const RequestIDHeader = "X-Request-ID"
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// Setup installs the default slog logger with the given level
+// (debug, info, warn, error) and format (text, json).
+func Setup(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// newRequestID returns a random 16 hex character request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestLogger returns the default logger annotated with the request ID of ctx, if any.
+func RequestLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// SetRequestID copies the request ID of ctx onto an outbound request.
+func SetRequestID(ctx context.Context, req *http.Request) {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// LogRequest assigns a request ID to every incoming HTTP request (reusing the
+// caller's X-Request-ID if present) and logs the method and path.
+func LogRequest(handlerName string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+		RequestLogger(r.Context()).Info("handler called", "handler", handlerName, "method", r.Method, "path", r.URL.Path)
+		next(w, r)
+	}
+}
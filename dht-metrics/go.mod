@@ -0,0 +1,3 @@
+module dht-metrics
+
+go 1.24.3
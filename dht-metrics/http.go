@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounter("dht_http_requests_total",
+		"HTTP requests handled, by handler and status code.", "handler", "code")
+	httpDuration = NewHistogram("dht_http_request_duration_seconds",
+		"Time spent handling HTTP requests, by handler.", DefBuckets, "handler")
+)
+
+// statusRecorder remembers the status code written by a handler. It keeps
+// http.Flusher working so streaming handlers still flush.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if fl, ok := sr.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// InstrumentHandler counts requests and measures latency for a handler.
+func InstrumentHandler(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		httpRequests.Inc(handler, strconv.Itoa(sr.status))
+		httpDuration.Observe(time.Since(start).Seconds(), handler)
+	}
+}
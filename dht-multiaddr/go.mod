@@ -0,0 +1,3 @@
+module dht-multiaddr
+
+go 1.24.3
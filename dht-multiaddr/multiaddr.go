@@ -0,0 +1,129 @@
+// Package multiaddr parses and formats typed peer addresses in a
+// multiaddr-style notation. It is shared by dht-node and dht-network.
+package multiaddr
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Addr is a typed peer address. Its string form is multiaddr-style, naming
+// the IP version (or dns) and the transport:
+//
+//	/ip4/10.0.0.5/tcp/8081
+//	/ip6/fd00::2/tcp/8081
+//	/dns/node-a.lan/tcp/8081
+type Addr struct {
+	Transport string // only tcp (HTTP over TCP) is supported
+	IPVersion int    // 4 or 6, 0 for a DNS name
+	Host      string
+	Port      int
+}
+
+// Parse parses a multiaddr-style address, or a plain host:port (with
+// IPv6 literals in brackets).
+func Parse(s string) (Addr, error) {
+	if !strings.HasPrefix(s, "/") {
+		return parseHostPort(s)
+	}
+	parts := strings.Split(strings.TrimPrefix(s, "/"), "/")
+	if len(parts) != 4 {
+		return Addr{}, fmt.Errorf("address %q: want /<ip4|ip6|dns>/<host>/tcp/<port>", s)
+	}
+	a := Addr{Host: parts[1], Transport: parts[2]}
+	switch parts[0] {
+	case "ip4":
+		a.IPVersion = 4
+	case "ip6":
+		a.IPVersion = 6
+	case "dns":
+	default:
+		return Addr{}, fmt.Errorf("address %q: unknown protocol %q", s, parts[0])
+	}
+	if ip := net.ParseIP(a.Host); a.IPVersion != 0 && (ip == nil || ipVersion(ip) != a.IPVersion) {
+		return Addr{}, fmt.Errorf("address %q: %q is not an IPv%d address", s, a.Host, a.IPVersion)
+	}
+	if a.Transport != "tcp" {
+		return Addr{}, fmt.Errorf("address %q: unsupported transport %q", s, a.Transport)
+	}
+	port, err := ParsePort(parts[3])
+	if err != nil {
+		return Addr{}, fmt.Errorf("address %q: %w", s, err)
+	}
+	a.Port = port
+	return a, nil
+}
+
+func parseHostPort(s string) (Addr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, fmt.Errorf("address %q: %w", s, err)
+	}
+	if host == "" {
+		return Addr{}, fmt.Errorf("address %q: missing host", s)
+	}
+	port, err := ParsePort(portStr)
+	if err != nil {
+		return Addr{}, fmt.Errorf("address %q: %w", s, err)
+	}
+	a := Addr{Transport: "tcp", Host: host, Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IPVersion = ipVersion(ip)
+	}
+	return a, nil
+}
+
+// ParsePort parses a TCP port number (1-65535).
+func ParsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+func ipVersion(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// String returns the multiaddr-style form of a.
+func (a Addr) String() string {
+	proto := "dns"
+	if a.IPVersion != 0 {
+		proto = "ip" + strconv.Itoa(a.IPVersion)
+	}
+	return fmt.Sprintf("/%s/%s/%s/%d", proto, a.Host, a.Transport, a.Port)
+}
+
+// HostPort returns a as host:port for dialing and URLs, with IPv6 literals
+// in brackets.
+func (a Addr) HostPort() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+func (a Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Addr) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// HostPorts returns the host:port form of every address.
+func HostPorts(addrs []Addr) []string {
+	result := make([]string, len(addrs))
+	for i, a := range addrs {
+		result[i] = a.HostPort()
+	}
+	return result
+}
@@ -2,22 +2,16 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
-)
 
-// logRequest logs the method and path of every incoming HTTP request.
-func logRequest(handlerName string, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] %s called: %s %s", handlerName, r.Method, r.URL.Path)
-		next(w, r)
-	}
-}
+	"dht-logging"
+)
 
-// pingHandler responds with this node's ID and address.
-func pingHandler(nodeID, address string) http.HandlerFunc {
+// pingHandler responds with this node's ID, addresses and role, and the
+// address the ping came from.
+func pingHandler(nodeID, role string, adv *Advertised) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp := PeerInfo{NodeID: nodeID, Address: address}
+		resp := PingResponse{PeerInfo: adv.Info(nodeID), ObservedAddr: observedAddr(r), Role: role}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
@@ -31,18 +25,20 @@ func peersHandler(pl *PeerList) http.HandlerFunc {
 	}
 }
 
-// registerHandler allows a peer to announce itself.
+// registerHandler allows a peer to announce itself, and tells it the address
+// the announcement came from.
 func registerHandler(pl *PeerList) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] /register called: %s %s", r.Method, r.URL.Path)
+		logger := logging.RequestLogger(r.Context())
 		var peer PeerInfo
-		if err := json.NewDecoder(r.Body).Decode(&peer); err == nil {
-			log.Printf("[HANDLER] /register received peer: %+v", peer)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegisterMessageSize)).Decode(&peer); err == nil {
+			logger.Info("peer registered", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 			pl.Add(peer)
 			logPeerList(pl, "/register END")
-			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(RegisterResponse{Status: "registered", ObservedAddr: observedAddr(r)})
 		} else {
-			log.Printf("[HANDLER] /register decode error: %v", err)
+			logger.Warn("register decode error", "err", err)
 			w.WriteHeader(http.StatusBadRequest)
 		}
 	}
@@ -51,14 +47,13 @@ func registerHandler(pl *PeerList) http.HandlerFunc {
 // findNodeHandler returns the k closest peers to the target node ID.
 func findNodeHandler(pl *PeerList, selfID string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] /find_node called: %s %s", r.Method, r.URL.Path)
 		target := r.URL.Query().Get("target")
 		if target == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		closest := pl.closestPeers(target, 3, selfID)
-		log.Printf("[HANDLER] /find_node for target %s: returning %d peers", target, len(closest))
+		logging.RequestLogger(r.Context()).Info("find_node", "target", target, "returned", len(closest))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(closest)
 	}
@@ -1,20 +1,74 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"dht-logging"
+	"dht-metrics"
+	"dht-multiaddr"
+	"dht-pex"
+	"dht-swim"
 )
 
 func main() {
 	// Command-line flags
-	var bootstrapAddr string
-	flag.StringVar(&bootstrapAddr, "bootstrap", "", "Bootstrap node address (host:port)")
+	var bootstrapAddr, advertiseAddr, logLevel, logFormat string
+	var rpcTimeout, bootstrapRefresh, peerTTL, livenessInterval, pexInterval time.Duration
+	var swimInterval, swimPingTimeout, swimSuspectTimeout time.Duration
+	var rendezvous bool
+	var sampleSize, registerRate, pexSampleSize, pexMergeRate, swimIndirect int
+	flag.StringVar(&bootstrapAddr, "bootstrap", "", "Bootstrap node address (host:port or multiaddr-style)")
+	flag.StringVar(&advertiseAddr, "advertise-addr", "", "Comma-separated addresses (host:port or /ip4/<ip>/tcp/<port>) to give peers, most preferred first (default: learned from peers when listening on all interfaces)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format (text, json)")
+	flag.DurationVar(&rpcTimeout, "rpc-timeout", 3*time.Second, "Timeout for each call to another node")
+	flag.DurationVar(&bootstrapRefresh, "bootstrap-refresh", time.Minute, "How often to register again with the bootstrap node")
+	flag.BoolVar(&rendezvous, "rendezvous", false, "Run as a rendezvous node: keep a registry of live peers and hand out samples of it")
+	flag.IntVar(&sampleSize, "sample-size", defaultSampleSize, "Rendezvous: peers returned by /peers")
+	flag.DurationVar(&peerTTL, "peer-ttl", defaultPeerTTL, "Rendezvous: forget peers that have not registered again for this long")
+	flag.DurationVar(&livenessInterval, "liveness-interval", defaultLivenessInterval, "Rendezvous: ping peers not heard from for this long, dropping those that do not answer")
+	flag.IntVar(&registerRate, "register-rate", defaultRegisterRate, "Rendezvous: registrations allowed per minute from one source host")
+	flag.DurationVar(&pexInterval, "pex-interval", pex.DefaultInterval, "How often to exchange a sample of the routing table with a random peer (0 disables peer exchange)")
+	flag.IntVar(&pexSampleSize, "pex-sample-size", pex.DefaultSampleSize, "Peers sent in a peer exchange; larger samples received are cut to this size")
+	flag.IntVar(&pexMergeRate, "pex-merge-rate", pex.DefaultMergeRate, "Unknown peers from peer exchanges pinged and added per minute, at most")
+	flag.DurationVar(&swimInterval, "swim-interval", swim.DefaultInterval, "How often the failure detector probes a peer (0 disables failure detection)")
+	flag.DurationVar(&swimPingTimeout, "swim-ping-timeout", swim.DefaultPingTimeout, "Wait for a probed peer's answer before asking other peers to probe it")
+	flag.IntVar(&swimIndirect, "swim-indirect", swim.DefaultIndirect, "Peers asked to probe a peer that did not answer a direct probe")
+	flag.DurationVar(&swimSuspectTimeout, "swim-suspect-timeout", swim.DefaultSuspectTimeout, "How long a suspected peer has to refute the suspicion before it is confirmed dead and evicted")
 	flag.Parse()
 
+	if err := logging.Setup(logLevel, logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if rendezvous && bootstrapAddr != "" {
+		fmt.Fprintln(os.Stderr, "--rendezvous and --bootstrap cannot be combined")
+		os.Exit(2)
+	}
+	if sampleSize < 1 || registerRate < 1 || peerTTL <= 0 || livenessInterval <= 0 || bootstrapRefresh <= 0 {
+		fmt.Fprintln(os.Stderr, "--sample-size and --register-rate must be at least 1, durations must be positive")
+		os.Exit(2)
+	}
+	if pexInterval < 0 || pexSampleSize < 1 || pexSampleSize > pex.MaxSampleSize || pexMergeRate < 1 {
+		fmt.Fprintf(os.Stderr, "--pex-interval must not be negative, --pex-sample-size must be between 1 and %d, --pex-merge-rate at least 1\n", pex.MaxSampleSize)
+		os.Exit(2)
+	}
+	if swimInterval < 0 || swimPingTimeout <= 0 || swimInterval > 0 && swimPingTimeout >= swimInterval || swimIndirect < 0 || swimSuspectTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "--swim-ping-timeout must be positive and shorter than --swim-interval, --swim-indirect must not be negative, --swim-suspect-timeout must be positive")
+		os.Exit(2)
+	}
+
 	// Server address (default :8080, can override with first arg)
 	addr := ":8080"
 	if flag.NArg() > 0 {
@@ -22,33 +76,97 @@ func main() {
 	}
 
 	// Peer management
-	selfNodeID := generateNodeID(addr)
-	selfAddr := addr
-	if addr[0] == ':' {
-		selfAddr = "127.0.0.1" + addr
+	var advertise []string
+	for _, a := range strings.Split(advertiseAddr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			advertise = append(advertise, a)
+		}
 	}
+	adv, err := newAdvertised(addr, advertise)
+	if err != nil {
+		slog.Error("cannot determine advertised address", "err", err)
+		os.Exit(2)
+	}
+	selfNodeID := generateNodeID(adv)
 	pl := NewPeerList()
-	pl.Add(PeerInfo{NodeID: selfNodeID, Address: selfAddr})
+	pl.Add(adv.Info(selfNodeID))
 
-	// If bootstrap address is provided, join the network
+	var bootstrap multiaddr.Addr
 	if bootstrapAddr != "" {
-		joinNetwork(bootstrapAddr, selfAddr, selfNodeID, pl)
+		if bootstrap, err = multiaddr.Parse(bootstrapAddr); err != nil {
+			slog.Error("invalid bootstrap address", "err", err)
+			os.Exit(2)
+		}
 	}
 
+	// Listen before joining: the bootstrap node may ping back
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("cannot listen", "addr", addr, "err", err)
+		os.Exit(1)
+	}
 	fmt.Printf("Node ID: %s\n", selfNodeID)
 
-	// Register HTTP handlers with logging
-	http.HandleFunc("/ping", logRequest("/ping", pingHandler(selfNodeID, selfAddr)))
-	http.HandleFunc("/peers", logRequest("/peers", peersHandler(pl)))
-	http.HandleFunc("/register", registerHandler(pl))
-	http.HandleFunc("/find_node", logRequest("/find_node", findNodeHandler(pl, selfNodeID)))
+	// Register HTTP handlers with request IDs, logging and metrics
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.HandleFunc(pattern, metrics.InstrumentHandler(pattern, logging.LogRequest(pattern, h)))
+	}
+	ctx := context.Background()
+	if rendezvous {
+		// Rendezvous mode: no routing table, only the registry
+		rg := newRegistry(peerTTL)
+		go rg.maintain(ctx, livenessInterval, rpcTimeout)
+		registerRendezvousMetrics(rg)
+		handle("/ping", pingHandler(selfNodeID, roleRendezvous, adv))
+		handle("/peers", samplePeersHandler(rg, sampleSize))
+		handle("/register", rendezvousRegisterHandler(rg, newSourceLimiter(registerRate), rpcTimeout))
+		handle("/find_node", rendezvousFindNodeHandler(rg))
+	} else {
+		// If bootstrap address is provided, join the network and keep the
+		// registration fresh
+		if bootstrapAddr != "" {
+			go func() {
+				joinNetwork(ctx, bootstrap.HostPort(), selfNodeID, adv, pl, rpcTimeout)
+				refreshRegistration(ctx, bootstrap.HostPort(), selfNodeID, adv, pl, rpcTimeout, bootstrapRefresh)
+			}()
+		}
+		go reannounce(ctx, adv, selfNodeID, pl, rpcTimeout)
+		exchange := pex.New(pexTable{selfNodeID, adv, pl, rpcTimeout}, pexClient{}, pexSampleSize, pexMergeRate, rpcTimeout)
+		if pexInterval > 0 {
+			go exchange.Run(ctx, pexInterval)
+		}
+		membership := swim.New(selfNodeID, swimTable{pl, selfNodeID}, swimClient{}, swimPingTimeout, swimIndirect, swimSuspectTimeout)
+		if swimInterval > 0 {
+			go membership.Run(ctx, swimInterval)
+		}
+		registerNetworkMetrics(pl, selfNodeID)
+		handle("/ping", pingHandler(selfNodeID, "", adv))
+		handle("/peers", peersHandler(pl))
+		handle("/register", registerHandler(pl))
+		handle("/find_node", findNodeHandler(pl, selfNodeID))
+		handle("/pex", pex.Handler(exchange))
+		handle("/swim/ping", swim.PingHandler(membership))
+		handle("/swim/ping-req", swim.PingReqHandler(membership))
+	}
+	http.HandleFunc("/metrics", metrics.Handler())
 
-	log.Printf("Listening on %s...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	slog.Info("listening", "addr", addr, "rendezvous", rendezvous)
+	if err := http.Serve(ln, nil); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
 }
 
-// generateNodeID creates a node ID from the address using SHA-1
-func generateNodeID(addr string) string {
-	h := sha1.Sum([]byte(addr))
+// generateNodeID returns the node ID: the first 8 bytes of the SHA-1 of the
+// primary advertised address when that is fixed, so the ID stays the same
+// across restarts. A node that learns its address from peers would start
+// out as 127.0.0.1 like every other such node, so it picks a random ID.
+func generateNodeID(adv *Advertised) string {
+	if !adv.Fixed() {
+		b := make([]byte, 8)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	h := sha1.Sum([]byte(adv.Primary()))
 	return hex.EncodeToString(h[:8])
 }
@@ -0,0 +1,23 @@
+package main
+
+import "dht-metrics"
+
+var peerRPCFailures = metrics.NewCounter("dht_peer_rpc_failures_total",
+	"Failed outbound calls to peers.")
+
+// registerNetworkMetrics exposes the routing table size on /metrics.
+func registerNetworkMetrics(pl *PeerList, selfID string) {
+	metrics.NewGaugeFunc("dht_routing_table_peers", "Number of peers in the routing table.", func() float64 {
+		return float64(len(pl.Others(selfID)))
+	})
+}
+
+var registrationsRejected = metrics.NewCounter("dht_rendezvous_registrations_rejected_total",
+	"Registrations refused by a rendezvous node, by reason.", "reason")
+
+// registerRendezvousMetrics exposes the registry size on /metrics.
+func registerRendezvousMetrics(rg *Registry) {
+	metrics.NewGaugeFunc("dht_rendezvous_peers", "Number of live registrations.", func() float64 {
+		return float64(len(rg.Live()))
+	})
+}
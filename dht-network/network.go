@@ -2,113 +2,186 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
-// pingBootstrap pings the bootstrap node and returns its PeerInfo.
-func pingBootstrap(bootstrapAddr string) (PeerInfo, error) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s/ping", bootstrapAddr))
+// joinLogger returns the logger used for join progress.
+func joinLogger() *slog.Logger {
+	return slog.Default().With("component", "join")
+}
+
+// getJSON fetches url from a peer and decodes the JSON response into v.
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return PeerInfo{}, err
+		return err
 	}
 	defer resp.Body.Close()
-	var bootstrap PeerInfo
-	if err := json.NewDecoder(resp.Body).Decode(&bootstrap); err != nil {
-		return PeerInfo{}, err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// pingPeer pings the node at addr and returns its PeerInfo and the address
+// it saw the ping coming from.
+func pingPeer(ctx context.Context, addr string) (PingResponse, error) {
+	var resp PingResponse
+	if err := getJSON(ctx, fmt.Sprintf("http://%s/ping", addr), &resp); err != nil {
+		peerRPCFailures.Inc()
+		return PingResponse{}, err
+	}
+	return resp, nil
+}
+
+// addIfLive pings peer at its address and, if it answers with its node ID,
+// adds it to the routing table at that address. Rendezvous nodes are not
+// added.
+func addIfLive(ctx context.Context, peer PeerInfo, adv *Advertised, pl *PeerList, rpcTimeout time.Duration) bool {
+	pingCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	pong, err := pingPeer(pingCtx, peer.Address)
+	cancel()
+	if err != nil || pong.NodeID != peer.NodeID || pong.Role == roleRendezvous {
+		return false
 	}
-	return bootstrap, nil
+	live := pong.PeerInfo
+	live.Address = peer.Address
+	pl.Add(live)
+	adv.Observe(live.NodeID, pong.ObservedAddr)
+	return true
 }
 
 // fetchBootstrapPeers fetches the peer list from the bootstrap node and merges it into the local peer list.
-func fetchBootstrapPeers(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s/peers", bootstrapAddr))
-	if err != nil {
-		log.Printf("[JOIN] Failed to fetch peers from bootstrap: %v", err)
+func fetchBootstrapPeers(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList) {
+	var peers []PeerInfo
+	if err := getJSON(ctx, fmt.Sprintf("http://%s/peers", bootstrapAddr), &peers); err != nil {
+		joinLogger().Warn("failed to fetch peers from bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		peerRPCFailures.Inc()
 		return
 	}
-	defer resp.Body.Close()
-	var peers []PeerInfo
-	if err := json.NewDecoder(resp.Body).Decode(&peers); err == nil {
-		log.Printf("[JOIN] Fetched %d peers from bootstrap node", len(peers))
-		for _, p := range peers {
-			if p.NodeID != selfNodeID && p.Address != selfAddr {
-				pl.Add(p)
-			}
+	for _, p := range peers {
+		if p.NodeID != selfNodeID && !adv.Has(p.Address) {
+			pl.Add(p)
 		}
-		log.Printf("[JOIN] Merged %d peers from bootstrap", len(peers))
-	} else {
-		log.Printf("[JOIN] Failed to decode peers from bootstrap: %v", err)
 	}
+	joinLogger().Info("merged peers from bootstrap", "bootstrap", bootstrapAddr, "peers", len(peers))
 }
 
-// announceSelf registers this node with the bootstrap node.
-func announceSelf(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	selfInfo := PeerInfo{NodeID: selfNodeID, Address: selfAddr}
-	buf, _ := json.Marshal(selfInfo)
-	log.Println("[JOIN] Announcing self to bootstrap node via /register...")
+// announceSelf registers this node with bootstrap and records the address
+// bootstrap saw the registration coming from.
+func announceSelf(ctx context.Context, bootstrap PeerInfo, selfNodeID string, adv *Advertised, pl *PeerList) {
+	bootstrapAddr := bootstrap.Address
+	buf, _ := json.Marshal(adv.Info(selfNodeID))
 	logPeerList(pl, "joinNetwork BEFORE REGISTER")
-	regResp, err := client.Post(fmt.Sprintf("http://%s/register", bootstrapAddr), "application/json", bytes.NewReader(buf))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/register", bootstrapAddr), bytes.NewReader(buf))
+	if err != nil {
+		joinLogger().Warn("failed to announce self to bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	regResp, err := http.DefaultClient.Do(req)
 	if err == nil {
-		log.Printf("[JOIN] Announced self to bootstrap node at %s", bootstrapAddr)
-		log.Printf("[JOIN] /register response status: %s", regResp.Status)
 		body, _ := io.ReadAll(regResp.Body)
-		log.Printf("[JOIN] /register response body: %s", string(body))
 		regResp.Body.Close()
+		joinLogger().Info("announced self to bootstrap", "bootstrap", bootstrapAddr, "status", regResp.Status)
+		joinLogger().Debug("register response", "body", string(body))
+		var reg RegisterResponse
+		if json.Unmarshal(body, &reg) == nil && reg.ObservedAddr != "" {
+			adv.Observe(bootstrap.NodeID, reg.ObservedAddr)
+		}
 	} else {
-		log.Printf("[JOIN] Failed to announce self to bootstrap: %v", err)
+		joinLogger().Warn("failed to announce self to bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		peerRPCFailures.Inc()
 	}
 	logPeerList(pl, "joinNetwork END")
 }
 
 // kademliaLookup performs a Kademlia-style lookup for own node ID.
-func kademliaLookup(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	log.Printf("[JOIN] Performing Kademlia-style lookup for own node ID: %s", selfNodeID)
+func kademliaLookup(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList) {
+	joinLogger().Info("performing Kademlia-style lookup for own node ID", "target", selfNodeID)
 	lookupURL := fmt.Sprintf("http://%s/find_node?target=%s", bootstrapAddr, selfNodeID)
-	resp, err := client.Get(lookupURL)
-	if err == nil {
-		defer resp.Body.Close()
-		var foundPeers []PeerInfo
-		if err := json.NewDecoder(resp.Body).Decode(&foundPeers); err == nil {
-			log.Printf("[JOIN] /find_node returned %d peers", len(foundPeers))
-			for _, p := range foundPeers {
-				if p.NodeID != selfNodeID && p.Address != selfAddr {
-					pl.Add(p)
-				}
-			}
-			logPeerList(pl, "joinNetwork AFTER FIND_NODE")
-		} else {
-			log.Printf("[JOIN] Failed to decode /find_node response: %v", err)
+	var foundPeers []PeerInfo
+	if err := getJSON(ctx, lookupURL, &foundPeers); err != nil {
+		joinLogger().Warn("failed to call find_node", "bootstrap", bootstrapAddr, "err", err)
+		peerRPCFailures.Inc()
+		return
+	}
+	joinLogger().Info("find_node returned peers", "peers", len(foundPeers))
+	for _, p := range foundPeers {
+		if p.NodeID != selfNodeID && !adv.Has(p.Address) {
+			pl.Add(p)
 		}
-	} else {
-		log.Printf("[JOIN] Failed to call /find_node: %v", err)
 	}
+	logPeerList(pl, "joinNetwork AFTER FIND_NODE")
 }
 
-// joinNetwork orchestrates the full join process.
-func joinNetwork(bootstrapAddr, selfAddr, selfNodeID string, pl *PeerList) {
-	log.Printf("[JOIN] Attempting to join network via bootstrap node at %s", bootstrapAddr)
+// joinNetwork orchestrates the full join process. Each step is bounded by
+// rpcTimeout; cancelling ctx aborts the join.
+func joinNetwork(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList, rpcTimeout time.Duration) {
+	joinLogger().Info("attempting to join network", "bootstrap", bootstrapAddr)
 	logPeerList(pl, "joinNetwork START")
 
-	bootstrap, err := pingBootstrap(bootstrapAddr)
+	step := func(fn func(ctx context.Context)) {
+		stepCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+		defer cancel()
+		fn(stepCtx)
+	}
+
+	var pong PingResponse
+	var err error
+	step(func(ctx context.Context) { pong, err = pingPeer(ctx, bootstrapAddr) })
 	if err != nil {
-		log.Printf("[JOIN] Failed to ping bootstrap node: %v", err)
+		joinLogger().Error("failed to ping bootstrap node", "bootstrap", bootstrapAddr, "err", err)
 		return
 	}
-	pl.Add(bootstrap)
-	log.Printf("[JOIN] Added bootstrap peer: %+v", bootstrap)
+	bootstrap := pong.PeerInfo
+	adv.Observe(bootstrap.NodeID, pong.ObservedAddr)
+	// A rendezvous node only helps with joining and is not a peer
+	if pong.Role != roleRendezvous {
+		pl.Add(bootstrap)
+		joinLogger().Info("added bootstrap peer", "peer_id", bootstrap.NodeID, "peer_addr", bootstrap.Address)
+	}
+
+	step(func(ctx context.Context) { fetchBootstrapPeers(ctx, bootstrapAddr, selfNodeID, adv, pl) })
+	// Register through the address that answered, which may differ from the
+	// one the bootstrap node advertises
+	dialed := PeerInfo{NodeID: bootstrap.NodeID, Address: bootstrapAddr}
+	step(func(ctx context.Context) { announceSelf(ctx, dialed, selfNodeID, adv, pl) })
+	step(func(ctx context.Context) { kademliaLookup(ctx, bootstrapAddr, selfNodeID, adv, pl) })
+	if pong.Role == roleRendezvous {
+		// Nobody else learns about this node from a rendezvous node, so
+		// introduce it to the peers found through it
+		for _, p := range pl.Others(selfNodeID) {
+			step(func(ctx context.Context) { announceSelf(ctx, p, selfNodeID, adv, pl) })
+		}
+	}
 
-	fetchBootstrapPeers(bootstrapAddr, selfNodeID, selfAddr, pl)
-	announceSelf(bootstrapAddr, selfNodeID, selfAddr, pl)
-	kademliaLookup(bootstrapAddr, selfNodeID, selfAddr, pl)
+	joinLogger().Info("discovery and connection process complete")
+}
 
-	log.Printf("[JOIN] Discovery and connection process complete.")
+// refreshRegistration registers this node again with the bootstrap node every
+// interval, until ctx is done. A rendezvous node forgets peers that stop.
+func refreshRegistration(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList, rpcTimeout, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		announceCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+		announceSelf(announceCtx, PeerInfo{Address: bootstrapAddr}, selfNodeID, adv, pl)
+		cancel()
+	}
 }
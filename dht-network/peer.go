@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
-	"log"
+	"log/slog"
 	"sort"
 	"sync"
+
+	"dht-multiaddr"
 )
 
 // PeerInfo holds information about a peer node
 type PeerInfo struct {
-	NodeID  string `json:"node_id"`
-	Address string `json:"address"`
+	NodeID    string           `json:"node_id"`
+	Address   string           `json:"address"`             // primary address (host:port), what older nodes read
+	Addresses []multiaddr.Addr `json:"addresses,omitempty"` // every advertised address, in the peer's order of preference
 }
 
 // PeerList manages a thread-safe list of peers
@@ -24,18 +28,36 @@ func NewPeerList() *PeerList {
 }
 
 func (pl *PeerList) Add(peer PeerInfo) {
+	if peer.Address == "" && len(peer.Addresses) > 0 {
+		peer.Address = peer.Addresses[0].HostPort()
+	}
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if peer.NodeID != "" && peer.Address != "" {
 		if _, exists := pl.peers[peer.NodeID]; !exists {
-			log.Printf("Discovered new peer: %s at %s", peer.NodeID, peer.Address)
+			slog.Info("discovered new peer", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 		} else {
-			log.Printf("Peer already known: %s at %s", peer.NodeID, peer.Address)
+			slog.Debug("peer already known", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 		}
 		pl.peers[peer.NodeID] = peer
 	}
 }
 
+// Get returns the peer with nodeID, if known.
+func (pl *PeerList) Get(nodeID string) (PeerInfo, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	p, ok := pl.peers[nodeID]
+	return p, ok
+}
+
+// Remove drops the peer with nodeID from the routing table.
+func (pl *PeerList) Remove(nodeID string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	delete(pl.peers, nodeID)
+}
+
 func (pl *PeerList) All() []PeerInfo {
 	pl.mu.RLock()
 	defer pl.mu.RUnlock()
@@ -46,12 +68,30 @@ func (pl *PeerList) All() []PeerInfo {
 	return result
 }
 
-// Print the current routing table (peer list)
-func logPeerList(pl *PeerList, context string) {
-	log.Printf("[%s] Current routing table:", context)
-	for _, p := range pl.All() {
-		log.Printf("  Peer: %s at %s", p.NodeID, p.Address)
+// Others returns all known peers except the node with selfID
+func (pl *PeerList) Others(selfID string) []PeerInfo {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	result := make([]PeerInfo, 0, len(pl.peers))
+	for _, p := range pl.peers {
+		if p.NodeID != selfID {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Log the current routing table (peer list) at debug level
+func logPeerList(pl *PeerList, label string) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	peers := pl.All()
+	entries := make([]string, 0, len(peers))
+	for _, p := range peers {
+		entries = append(entries, p.NodeID+"@"+p.Address)
 	}
+	slog.Debug("current routing table", "context", label, "peers", entries)
 }
 
 // xorDistance computes the XOR distance between two node IDs (as hex strings)
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"dht-pex"
+)
+
+// pexTable is the routing table as the peer exchange sees it.
+type pexTable struct {
+	selfID     string
+	adv        *Advertised
+	pl         *PeerList
+	rpcTimeout time.Duration
+}
+
+func (t pexTable) Self() pex.Peer {
+	return pex.Peer(t.adv.Info(t.selfID))
+}
+
+func (t pexTable) Members() []pex.Peer {
+	peers := t.pl.Others(t.selfID)
+	result := make([]pex.Peer, len(peers))
+	for i, p := range peers {
+		result[i] = pex.Peer(p)
+	}
+	return result
+}
+
+func (t pexTable) Known(nodeID string) bool {
+	_, ok := t.pl.Get(nodeID)
+	return ok
+}
+
+// Seen does nothing: the routing table does not track when peers were seen.
+func (t pexTable) Seen(nodeID string) {}
+
+func (t pexTable) IsSelf(hostPort string) bool {
+	return t.adv.Has(hostPort)
+}
+
+func (t pexTable) AddIfLive(ctx context.Context, p pex.Peer) bool {
+	return addIfLive(ctx, PeerInfo(p), t.adv, t.pl, t.rpcTimeout)
+}
+
+// pexClient sends exchanges with the default HTTP client.
+type pexClient struct{}
+
+func (pexClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		peerRPCFailures.Inc()
+	}
+	return resp, err
+}
+
+// Available is always true: there are no circuit breakers to consult.
+func (pexClient) Available(hostPort string) bool {
+	return true
+}
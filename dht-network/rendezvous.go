@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"dht-logging"
+	"dht-multiaddr"
+)
+
+const (
+	defaultSampleSize       = 16
+	defaultPeerTTL          = 3 * time.Minute
+	defaultLivenessInterval = time.Minute
+	defaultRegisterRate     = 10 // registrations per minute per source host
+
+	// maxTrackedSources bounds the rate limiter's memory; beyond it, sources
+	// whose allowance has fully refilled are forgotten.
+	maxTrackedSources = 4096
+
+	// maxRegisterCandidates bounds the addresses pinged for one registration,
+	// the host it came from included.
+	maxRegisterCandidates = 4
+)
+
+// roleRendezvous is reported in /ping by a node in rendezvous mode, so that
+// joiners use it for bootstrapping only and keep it out of their routing
+// table.
+const roleRendezvous = "rendezvous"
+
+// Registry is the membership kept by a rendezvous node: peers that
+// registered, answered a ping at their address, and refreshed their
+// registration within ttl.
+type Registry struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*registration // key: NodeID
+}
+
+type registration struct {
+	info      PeerInfo
+	refreshed time.Time // last registration
+	verified  time.Time // last time the peer answered a ping
+}
+
+func newRegistry(ttl time.Duration) *Registry {
+	return &Registry{ttl: ttl, peers: make(map[string]*registration)}
+}
+
+// Refresh records a registration from a peer that has just answered a ping.
+func (rg *Registry) Refresh(p PeerInfo) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	now := time.Now()
+	if _, ok := rg.peers[p.NodeID]; !ok {
+		slog.Info("peer registered", "peer_id", p.NodeID, "peer_addr", p.Address)
+	}
+	rg.peers[p.NodeID] = &registration{info: p, refreshed: now, verified: now}
+}
+
+// Live returns every peer whose registration has not expired.
+func (rg *Registry) Live() []PeerInfo {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	result := make([]PeerInfo, 0, len(rg.peers))
+	for _, r := range rg.peers {
+		if time.Since(r.refreshed) < rg.ttl {
+			result = append(result, r.info)
+		}
+	}
+	return result
+}
+
+// Sample returns up to n live peers picked at random and spread across the
+// ID space: peers are grouped by the first hex digit of their node ID, and
+// the groups take turns in random order.
+func (rg *Registry) Sample(n int) []PeerInfo {
+	groups := make(map[byte][]PeerInfo)
+	for _, p := range rg.Live() {
+		if p.NodeID != "" {
+			groups[p.NodeID[0]] = append(groups[p.NodeID[0]], p)
+		}
+	}
+	keys := make([]byte, 0, len(groups))
+	for k, g := range groups {
+		rand.Shuffle(len(g), func(i, j int) { g[i], g[j] = g[j], g[i] })
+		keys = append(keys, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	sample := make([]PeerInfo, 0, n)
+	for len(sample) < n && len(keys) > 0 {
+		next := keys[:0]
+		for _, k := range keys {
+			if len(sample) == n {
+				break
+			}
+			sample = append(sample, groups[k][0])
+			if groups[k] = groups[k][1:]; len(groups[k]) > 0 {
+				next = append(next, k)
+			}
+		}
+		keys = next
+	}
+	return sample
+}
+
+// Closest returns up to k live peers closest to target by XOR distance.
+func (rg *Registry) Closest(target string, k int) []PeerInfo {
+	peers := rg.Live()
+	sort.Slice(peers, func(i, j int) bool {
+		return xorDistance(peers[i].NodeID, target) < xorDistance(peers[j].NodeID, target)
+	})
+	if len(peers) > k {
+		peers = peers[:k]
+	}
+	return peers
+}
+
+// maintain drops expired registrations and pings every peer not verified for
+// livenessInterval, dropping those that do not answer, until ctx is done.
+func (rg *Registry) maintain(ctx context.Context, livenessInterval, rpcTimeout time.Duration) {
+	ticker := time.NewTicker(livenessInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var unverified []PeerInfo
+		rg.mu.Lock()
+		for id, r := range rg.peers {
+			switch {
+			case time.Since(r.refreshed) >= rg.ttl:
+				slog.Info("registration expired", "peer_id", id, "peer_addr", r.info.Address)
+				delete(rg.peers, id)
+			case time.Since(r.verified) >= livenessInterval:
+				unverified = append(unverified, r.info)
+			}
+		}
+		rg.mu.Unlock()
+
+		for _, p := range unverified {
+			pingCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+			pong, err := pingPeer(pingCtx, p.Address)
+			cancel()
+			rg.mu.Lock()
+			if r, ok := rg.peers[p.NodeID]; ok {
+				if err == nil && pong.NodeID == p.NodeID {
+					r.verified = time.Now()
+				} else {
+					slog.Info("registered peer not answering, dropped", "peer_id", p.NodeID, "peer_addr", p.Address, "err", err)
+					delete(rg.peers, p.NodeID)
+				}
+			}
+			rg.mu.Unlock()
+		}
+	}
+}
+
+// sourceLimiter allows each source host a burst of rate registrations, with
+// the allowance refilling at rate per minute.
+type sourceLimiter struct {
+	rate float64 // per minute
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // key: source host
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newSourceLimiter(rate int) *sourceLimiter {
+	return &sourceLimiter{rate: float64(rate), buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes one registration from source's allowance. If none is left it
+// returns false and how long until one is.
+func (l *sourceLimiter) Allow(source string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.buckets) >= maxTrackedSources {
+		for s, b := range l.buckets {
+			if b.refill(now, l.rate) >= l.rate {
+				delete(l.buckets, s)
+			}
+		}
+	}
+	b, ok := l.buckets[source]
+	if !ok {
+		b = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[source] = b
+	}
+	if b.refill(now, l.rate) < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Minute))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64) float64 {
+	b.tokens = math.Min(rate, b.tokens+now.Sub(b.last).Minutes()*rate)
+	b.last = now
+	return b.tokens
+}
+
+// reachableAddr pings a registering peer at its advertised addresses, then at
+// the host the registration came from with the peer's port, and returns the
+// first address at which it answers with its node ID. At most
+// maxRegisterCandidates addresses are tried, and none once ctx is done.
+func reachableAddr(ctx context.Context, p PeerInfo, source string, rpcTimeout time.Duration) (string, error) {
+	var fromSource string
+	if _, port, err := net.SplitHostPort(p.Address); err == nil {
+		fromSource = net.JoinHostPort(source, port)
+	}
+	candidates := []string{p.Address}
+	for _, a := range multiaddr.HostPorts(p.Addresses) {
+		if len(candidates) == maxRegisterCandidates-1 {
+			break // keep room for the source host
+		}
+		if !slices.Contains(candidates, a) {
+			candidates = append(candidates, a)
+		}
+	}
+	if fromSource != "" && !slices.Contains(candidates, fromSource) {
+		candidates = append(candidates, fromSource)
+	}
+	for _, addr := range candidates {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, rpcTimeout)
+		pong, err := pingPeer(pingCtx, addr)
+		cancel()
+		if err == nil && pong.NodeID == p.NodeID {
+			return addr, nil
+		}
+	}
+	return "", errors.New("peer did not answer at any of its addresses")
+}
+
+// samplePeersHandler returns a random sample of live peers instead of the
+// whole membership. The optional n parameter asks for fewer than sampleSize.
+func samplePeersHandler(rg *Registry, sampleSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := sampleSize
+		if v := r.URL.Query().Get("n"); v != "" {
+			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 && parsed < n {
+				n = parsed
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rg.Sample(n))
+	}
+}
+
+// rendezvousRegisterHandler registers or refreshes a peer. Registrations are
+// rate-limited per source host, and a peer is only accepted once it answers
+// a ping.
+func rendezvousRegisterHandler(rg *Registry, limiter *sourceLimiter, rpcTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.RequestLogger(r.Context())
+		source, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ok, wait := limiter.Allow(source); !ok {
+			logger.Warn("registration rate limited", "source", source)
+			registrationsRejected.Inc("rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many registrations", http.StatusTooManyRequests)
+			return
+		}
+		var peer PeerInfo
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegisterMessageSize)).Decode(&peer); err != nil || peer.NodeID == "" {
+			logger.Warn("register decode error", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if peer.Address == "" && len(peer.Addresses) > 0 {
+			peer.Address = peer.Addresses[0].HostPort()
+		}
+		addr, err := reachableAddr(r.Context(), peer, source, rpcTimeout)
+		if err != nil {
+			logger.Warn("registering peer not reachable", "peer_id", peer.NodeID, "peer_addr", peer.Address, "err", err)
+			registrationsRejected.Inc("unreachable")
+			http.Error(w, fmt.Sprintf("%s: %v", peer.Address, err), http.StatusUnprocessableEntity)
+			return
+		}
+		peer.Address = addr
+		rg.Refresh(peer)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RegisterResponse{Status: "registered", ObservedAddr: observedAddr(r)})
+	}
+}
+
+// rendezvousFindNodeHandler returns the k closest live peers to the target
+// node ID.
+func rendezvousFindNodeHandler(rg *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		closest := rg.Closest(target, 3)
+		logging.RequestLogger(r.Context()).Info("find_node", "target", target, "returned", len(closest))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(closest)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"dht-swim"
+)
+
+// swimTable is the routing table as the failure detector sees it.
+type swimTable struct {
+	pl     *PeerList
+	selfID string
+}
+
+func (t swimTable) Members() []swim.Peer {
+	peers := t.pl.Others(t.selfID)
+	result := make([]swim.Peer, len(peers))
+	for i, p := range peers {
+		result[i] = swim.Peer{NodeID: p.NodeID, Address: p.Address}
+	}
+	return result
+}
+
+func (t swimTable) Lookup(nodeID string) (swim.Peer, bool) {
+	p, ok := t.pl.Get(nodeID)
+	return swim.Peer{NodeID: p.NodeID, Address: p.Address}, ok
+}
+
+func (t swimTable) Evict(nodeID string) {
+	t.pl.Remove(nodeID)
+}
+
+// Seen does nothing: the routing table does not track when peers were seen.
+func (t swimTable) Seen(nodeID string) {}
+
+// swimClient sends probes with the default HTTP client.
+type swimClient struct{}
+
+func (swimClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		peerRPCFailures.Inc()
+	}
+	return resp, err
+}
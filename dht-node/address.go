@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"dht-advertise"
+)
+
+// roleRendezvous is the /ping role of a dht-network node in rendezvous mode.
+// Joiners register with it and take peers from it, but keep it out of their
+// routing table, as it stores no content.
+const roleRendezvous = "rendezvous"
+
+// PingResponse is the /ping response: the node's PeerInfo plus the address
+// the ping came from, as the node saw it. Role is "rendezvous" for a
+// dht-network node that only helps others join.
+type PingResponse struct {
+	PeerInfo
+	ObservedAddr string `json:"observed_addr,omitempty"`
+	Role         string `json:"role,omitempty"`
+}
+
+// maxRegisterMessageSize bounds a /register request body, a single PeerInfo.
+const maxRegisterMessageSize = 64 << 10
+
+// RegisterResponse is the /register response.
+type RegisterResponse struct {
+	Status       string `json:"status"`
+	ObservedAddr string `json:"observed_addr,omitempty"`
+}
+
+// Advertised holds the addresses this node gives to peers, as tracked by the
+// shared advertise package.
+type Advertised struct {
+	*advertise.Addresses
+}
+
+// newAdvertised returns the advertised addresses for a node listening on
+// listenAddr. A non-empty addrs list (host:port or multiaddr-style) is used
+// as given.
+func newAdvertised(listenAddr string, addrs []string) (*Advertised, error) {
+	a, err := advertise.New(listenAddr, addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &Advertised{a}, nil
+}
+
+// Info returns the PeerInfo this node announces.
+func (a *Advertised) Info(nodeID string) PeerInfo {
+	addrs := a.All()
+	return PeerInfo{NodeID: nodeID, Address: addrs[0].HostPort(), Addresses: addrs}
+}
+
+// observedAddr returns the address a request came from.
+func observedAddr(r *http.Request) string {
+	return r.RemoteAddr
+}
+
+// reannounce registers this node with every known peer whenever its
+// advertised addresses change, until ctx is done. Each registration is
+// bounded by rpcTimeout.
+func reannounce(ctx context.Context, adv *Advertised, selfID string, pl *PeerList, rpcTimeout time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-adv.Changed():
+		}
+		pl.Add(adv.Info(selfID))
+		peers := pl.Others(selfID)
+		joinLogger().Info("re-announcing new address", "addr", adv.Primary(), "peers", len(peers))
+		for _, p := range peers {
+			announceCtx, cancel := withRPCTimeout(ctx, rpcTimeout)
+			announceSelf(announceCtx, p, selfID, adv, pl)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultBalanceSample = 10000
+
+// runBalance implements "dht-node balance": it reports how a sample of keys
+// spreads over a set of nodes under each placement strategy. The nodes come
+// from running nodes' addresses, from node IDs, or from the routing table of
+// a running node; the keys from a file or a random sample of content keys.
+func runBalance(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("balance", flag.ContinueOnError)
+	var addrs, ids listValue
+	strategies := listValue(placementNames)
+	fs.Var(&addrs, "addrs", "Comma-separated addresses of running nodes, whose node IDs are fetched with /ping")
+	fs.Var(&ids, "nodes", "Comma-separated node IDs")
+	from := fs.String("from", "", "Address of a running node whose routing table gives the nodes")
+	keysFile := fs.String("keys", "", "File with one key per line, - for stdin (default: random content keys)")
+	sample := fs.Int("sample", defaultBalanceSample, "Number of random keys when --keys is not given")
+	seed := fs.Uint64("seed", 1, "Seed for the random keys")
+	vnodes := fs.Int("placement-vnodes", defaultPlacementVnodes, "Ring points per node for consistent placement")
+	fs.Var(&strategies, "placement", "Comma-separated placement strategies to compare")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	for _, a := range addrs {
+		id, err := fetchNodeID(a)
+		if err != nil {
+			return fmt.Errorf("node ID of %s: %w", a, err)
+		}
+		ids = append(ids, id)
+	}
+	if *from != "" {
+		peers, err := fetchPeers(*from)
+		if err != nil {
+			return fmt.Errorf("routing table of %s: %w", *from, err)
+		}
+		for _, p := range peers {
+			ids = append(ids, p.NodeID)
+		}
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if len(ids) == 0 {
+		return errors.New("no nodes: give --addrs, --nodes or --from")
+	}
+
+	var keys []string
+	var err error
+	if *keysFile != "" {
+		keys, err = readKeys(*keysFile)
+	} else if *sample < 1 {
+		err = fmt.Errorf("--sample must be at least 1, got %d", *sample)
+	} else {
+		keys = randomKeys(*sample, *seed)
+	}
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys")
+	}
+
+	var placements []Placement
+	for _, name := range strategies {
+		p, err := newPlacement(name, *vnodes)
+		if err != nil {
+			return err
+		}
+		placements = append(placements, p)
+	}
+
+	// counts[i][j]: keys placed on node ids[j] by placements[i]
+	counts := make([][]int, len(placements))
+	for i, p := range placements {
+		counts[i] = make([]int, len(ids))
+		for _, key := range keys {
+			owner := 0
+			for j := 1; j < len(ids); j++ {
+				if comparePlacement(p, key, ids[j], ids[owner]) < 0 {
+					owner = j
+				}
+			}
+			counts[i][owner]++
+		}
+	}
+
+	fmt.Fprintf(out, "%d keys over %d nodes (mean %.1f per node)\n\n", len(keys), len(ids), float64(len(keys))/float64(len(ids)))
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "node\t")
+	for _, p := range placements {
+		fmt.Fprintf(tw, "%s\t", p.Name())
+	}
+	fmt.Fprintln(tw)
+	for j, id := range ids {
+		fmt.Fprintf(tw, "%s\t", id)
+		for i := range placements {
+			fmt.Fprintf(tw, "%d (%.1f%%)\t", counts[i][j], 100*float64(counts[i][j])/float64(len(keys)))
+		}
+		fmt.Fprintln(tw)
+	}
+	mean := float64(len(keys)) / float64(len(ids))
+	for _, row := range []struct {
+		name string
+		stat func(c []int) float64
+	}{
+		{"min/mean", func(c []int) float64 { return float64(slices.Min(c)) / mean }},
+		{"max/mean", func(c []int) float64 { return float64(slices.Max(c)) / mean }},
+		{"stddev/mean", func(c []int) float64 {
+			var sum float64
+			for _, n := range c {
+				sum += (float64(n) - mean) * (float64(n) - mean)
+			}
+			return math.Sqrt(sum/float64(len(c))) / mean
+		}},
+	} {
+		fmt.Fprintf(tw, "%s\t", row.name)
+		for i := range placements {
+			fmt.Fprintf(tw, "%.3f\t", row.stat(counts[i]))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// fetchNodeID returns the node ID of the node at addr.
+func fetchNodeID(addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := pingPeer(ctx, addr)
+	return resp.NodeID, err
+}
+
+// fetchPeers returns the routing table of the node at addr.
+func fetchPeers(addr string) ([]PeerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var peers []PeerInfo
+	err := getJSON(ctx, fmt.Sprintf("http://%s/peers", addr), &peers)
+	return peers, err
+}
+
+// readKeys reads one key per line from file, or from stdin for "-".
+// Blank lines are skipped.
+func readKeys(file string) ([]string, error) {
+	f := os.Stdin
+	if file != "-" {
+		var err error
+		if f, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var keys []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if k := strings.TrimSpace(sc.Text()); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys, sc.Err()
+}
+
+// randomKeys returns n content keys (hex SHA-1 of random data), the same
+// every time for the same seed.
+func randomKeys(n int, seed uint64) []string {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	keys := make([]string, n)
+	var buf [8]byte
+	for i := range keys {
+		binary.BigEndian.PutUint64(buf[:], rng.Uint64())
+		h := sha1.Sum(buf[:])
+		keys[i] = hex.EncodeToString(h[:])
+	}
+	return keys
+}
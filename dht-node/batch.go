@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"dht-logging"
+)
+
+type BatchPutRequest struct {
+	Items []PutRequest `json:"items"`
+}
+
+type BatchGetRequest struct {
+	Keys  []string `json:"keys,omitempty"`
+	Names []string `json:"names,omitempty"`
+}
+
+// BatchPutResult is one NDJSON line of the /batch/put response.
+type BatchPutResult struct {
+	PutResponse
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchGetResult is one NDJSON line of the /batch/get response.
+type BatchGetResult struct {
+	GetResponse
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ndjsonWriter writes one JSON object per line and flushes it right away so
+// results reach the client as soon as they are known.
+type ndjsonWriter struct {
+	enc *json.Encoder
+	fl  http.Flusher
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fl, _ := w.(http.Flusher)
+	return &ndjsonWriter{enc: json.NewEncoder(w), fl: fl}
+}
+
+func (nw *ndjsonWriter) Write(v any) {
+	nw.enc.Encode(v)
+	if nw.fl != nil {
+		nw.fl.Flush()
+	}
+}
+
+// batchPutHandler handles POST /batch/put. Items are grouped by responsible
+// peer and each group is sent to its peer in one request, in parallel.
+func batchPutHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BatchPutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logger := logging.RequestLogger(r.Context())
+		rt := incomingRoute(r)
+		var local []PutRequest
+		var refused []BatchPutResult
+		groups := make(map[string][]PutRequest)
+		peers := make(map[string]PeerInfo)
+		for _, item := range req.Items {
+			key := contentKey(item.Key, item.Name)
+			if key == "" {
+				local = append(local, item) // reported as a bad request by storeLocal
+				continue
+			}
+			peer, isSelf, err := nextHop(router, rt, key, maxHops)
+			if err != nil {
+				refused = append(refused, BatchPutResult{PutResponse: PutResponse{Key: key}, Name: item.Name, Status: http.StatusLoopDetected, Error: err.Error()})
+				continue
+			}
+			if isSelf {
+				local = append(local, item)
+				continue
+			}
+			groups[peer.NodeID] = append(groups[peer.NodeID], item)
+			peers[peer.NodeID] = peer
+		}
+
+		results := make(chan BatchPutResult)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, item := range local {
+				resp, status, msg := storeLocal(r.Context(), store, contentKey(item.Key, item.Name), item)
+				results <- BatchPutResult{PutResponse: resp, Name: item.Name, Status: status, Error: msg}
+			}
+			for _, res := range refused {
+				results <- res
+			}
+		}()
+		for id, items := range groups {
+			wg.Add(1)
+			go func(peer PeerInfo, items []PutRequest) {
+				defer wg.Done()
+				defer jobs.Start("batch_put")()
+				logger.Info("forwarding batch put", "keys", len(items), "peer_id", peer.NodeID, "peer_addr", peer.Address)
+				reported := make(map[string]bool)
+				err := postNDJSON(r.Context(), peer, "/batch/put", rt.forward(selfID), BatchPutRequest{Items: items}, func(line json.RawMessage) error {
+					var res BatchPutResult
+					if err := json.Unmarshal(line, &res); err != nil {
+						return err
+					}
+					reported[res.Key] = true
+					results <- res
+					return nil
+				})
+				if err == nil {
+					forwardedRequests.Inc("batch_put")
+					return
+				}
+				logger.Warn("batch put failed", "peer_addr", peer.Address, "err", err)
+				rpcErrors.Record(peer.Address)
+				for _, item := range items {
+					key := contentKey(item.Key, item.Name)
+					if !reported[key] {
+						results <- BatchPutResult{PutResponse: PutResponse{Key: key}, Name: item.Name, Status: forwardErrorStatus(err), Error: err.Error()}
+					}
+				}
+			}(peers[id], items)
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		out := newNDJSONWriter(w)
+		for res := range results {
+			out.Write(res)
+		}
+	}
+}
+
+// batchGetHandler handles POST /batch/get. Keys found locally are answered
+// immediately, the rest are grouped by responsible peer and fetched in parallel.
+func batchGetHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BatchGetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logger := logging.RequestLogger(r.Context())
+		rt := incomingRoute(r)
+		type lookup struct{ key, name string }
+		lookups := make([]lookup, 0, len(req.Keys)+len(req.Names))
+		for _, k := range req.Keys {
+			lookups = append(lookups, lookup{key: k})
+		}
+		for _, n := range req.Names {
+			lookups = append(lookups, lookup{key: contentKey("", n), name: n})
+		}
+
+		out := newNDJSONWriter(w)
+		groups := make(map[string]*BatchGetRequest)
+		peers := make(map[string]PeerInfo)
+		for _, l := range lookups {
+			if siblings, ok := store.Get(l.key); ok {
+				out.Write(BatchGetResult{GetResponse: newGetResponse(l.key, siblings), Name: l.name, Status: http.StatusOK})
+				continue
+			}
+			peer, isSelf, err := nextHop(router, rt, l.key, maxHops)
+			if err != nil {
+				out.Write(BatchGetResult{GetResponse: GetResponse{Key: l.key}, Name: l.name, Status: http.StatusLoopDetected, Error: err.Error()})
+				continue
+			}
+			if isSelf {
+				out.Write(BatchGetResult{GetResponse: GetResponse{Key: l.key}, Name: l.name, Status: http.StatusOK})
+				continue
+			}
+			g, ok := groups[peer.NodeID]
+			if !ok {
+				g = &BatchGetRequest{}
+				groups[peer.NodeID] = g
+				peers[peer.NodeID] = peer
+			}
+			if l.name != "" {
+				g.Names = append(g.Names, l.name)
+			} else {
+				g.Keys = append(g.Keys, l.key)
+			}
+		}
+
+		results := make(chan BatchGetResult)
+		var wg sync.WaitGroup
+		for id, g := range groups {
+			wg.Add(1)
+			go func(peer PeerInfo, g *BatchGetRequest) {
+				defer wg.Done()
+				defer jobs.Start("batch_get")()
+				logger.Info("forwarding batch get", "keys", len(g.Keys)+len(g.Names), "peer_id", peer.NodeID, "peer_addr", peer.Address)
+				reported := make(map[string]bool)
+				err := postNDJSON(r.Context(), peer, "/batch/get", rt.forward(selfID), g, func(line json.RawMessage) error {
+					var res BatchGetResult
+					if err := json.Unmarshal(line, &res); err != nil {
+						return err
+					}
+					reported[res.Key] = true
+					results <- res
+					return nil
+				})
+				if err == nil {
+					forwardedRequests.Inc("batch_get")
+					return
+				}
+				logger.Warn("batch get failed", "peer_addr", peer.Address, "err", err)
+				rpcErrors.Record(peer.Address)
+				for _, k := range g.Keys {
+					if !reported[k] {
+						results <- BatchGetResult{GetResponse: GetResponse{Key: k}, Status: forwardErrorStatus(err), Error: err.Error()}
+					}
+				}
+				for _, n := range g.Names {
+					if k := contentKey("", n); !reported[k] {
+						results <- BatchGetResult{GetResponse: GetResponse{Key: k}, Name: n, Status: forwardErrorStatus(err), Error: err.Error()}
+					}
+				}
+			}(peers[id], g)
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		for res := range results {
+			out.Write(res)
+		}
+	}
+}
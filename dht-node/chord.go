@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"dht-logging"
+)
+
+const (
+	defaultChordSuccessors        = 4
+	defaultChordStabilizeInterval = time.Second
+
+	// ringBits is the size of the identifier ring: node IDs are 64 bits.
+	ringBits = 64
+	// fingersPerRound is how many fingers fix_fingers refreshes per round, so
+	// the whole table is refreshed every ringBits/fingersPerRound rounds.
+	fingersPerRound = 8
+	// maxLookupHops bounds a find_successor lookup passed between nodes.
+	maxLookupHops = 32
+)
+
+// ringID returns the position of a node ID or key on the ring: its first 64
+// bits for a hex ID of at least 16 digits, otherwise the first 64 bits of its
+// SHA-1.
+func ringID(s string) uint64 {
+	if len(s) >= 16 {
+		if v, err := strconv.ParseUint(s[:16], 16, 64); err == nil {
+			return v
+		}
+	}
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// between reports whether x lies in the ring interval (a, b], going
+// clockwise from a. With a == b the interval is the whole ring.
+func between(x, a, b uint64) bool {
+	if a < b {
+		return a < x && x <= b
+	}
+	return a < x || x <= b
+}
+
+// betweenOpen reports whether x lies in the ring interval (a, b).
+func betweenOpen(x, a, b uint64) bool {
+	if a < b {
+		return a < x && x < b
+	}
+	return a < x || x < b
+}
+
+// ChordState is the /chord/state response: the node's view of its
+// neighbourhood on the ring.
+type ChordState struct {
+	Node        PeerInfo      `json:"node"`
+	Predecessor *PeerInfo     `json:"predecessor"`
+	Successors  []PeerInfo    `json:"successors"`
+	Fingers     []ChordFinger `json:"fingers,omitempty"`
+}
+
+// ChordFinger is a finger table entry: the first node at or after Start.
+type ChordFinger struct {
+	Index int      `json:"index"`
+	Start string   `json:"start"` // self + 2^index, hex
+	Node  PeerInfo `json:"node"`
+}
+
+// Chord places each key on the first node clockwise from it on the ring
+// (its successor). Each node keeps a list of its next few successors, a
+// pointer to its predecessor, and a finger table whose i-th entry is the
+// successor of self + 2^i. A request is forwarded to the successor when the
+// key falls between this node and it, otherwise to the finger closest before
+// the key, so a lookup takes O(log n) hops.
+//
+// The ring is kept correct by periodic stabilize (adopt the successor's
+// predecessor if it sits between us, then notify the successor),
+// fix_fingers and check_predecessor. A node that is alone on the ring joins
+// it through any peer in the routing table.
+type Chord struct {
+	selfID     string
+	adv        *Advertised
+	pl         *PeerList
+	successorN int
+	interval   time.Duration
+	rpcTimeout time.Duration
+
+	mu          sync.RWMutex
+	predecessor *PeerInfo
+	successors  []PeerInfo // nearest first, empty while alone
+	fingers     [ringBits]*PeerInfo
+	nextFinger  int
+}
+
+func newChord(selfID string, adv *Advertised, pl *PeerList, successorN int, interval, rpcTimeout time.Duration) *Chord {
+	return &Chord{selfID: selfID, adv: adv, pl: pl, successorN: successorN, interval: interval, rpcTimeout: rpcTimeout}
+}
+
+func (c *Chord) Name() string { return routingChord }
+
+// Distance returns the clockwise distance from id to key.
+func (c *Chord) Distance(id, key string) uint64 { return ringID(key) - ringID(id) }
+
+// NextHop returns the successor of key if the key lies between this node and
+// its first reachable successor, this node if the key lies between its
+// predecessor and itself, and otherwise the closest preceding node.
+func (c *Chord) NextHop(key string) (PeerInfo, bool) {
+	id, self := ringID(key), ringID(c.selfID)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.predecessor != nil && between(id, ringID(c.predecessor.NodeID), self) {
+		return PeerInfo{}, true
+	}
+	succ, ok := c.successorLocked()
+	if !ok {
+		return PeerInfo{}, true
+	}
+	if between(id, self, ringID(succ.NodeID)) {
+		return succ, false
+	}
+	if p, ok := c.closestPrecedingLocked(id); ok {
+		return p, false
+	}
+	return succ, false
+}
+
+// successorLocked returns the first successor whose circuit breaker is
+// closed. Keys of a failed successor belong to the next one.
+func (c *Chord) successorLocked() (PeerInfo, bool) {
+	for _, s := range c.successors {
+		if peerClient.Available(s.Address) {
+			return s, true
+		}
+	}
+	return PeerInfo{}, false
+}
+
+// closestPrecedingLocked returns the reachable finger or successor that is
+// closest before id on the ring.
+func (c *Chord) closestPrecedingLocked(id uint64) (PeerInfo, bool) {
+	self := ringID(c.selfID)
+	best, found := PeerInfo{}, false
+	consider := func(p PeerInfo) {
+		pos := ringID(p.NodeID)
+		if !betweenOpen(pos, self, id) || !peerClient.Available(p.Address) {
+			return
+		}
+		if !found || betweenOpen(pos, ringID(best.NodeID), id) {
+			best, found = p, true
+		}
+	}
+	for _, f := range c.fingers {
+		if f != nil {
+			consider(*f)
+		}
+	}
+	for _, s := range c.successors {
+		consider(s)
+	}
+	return best, found
+}
+
+// findSuccessor returns the node responsible for id, asking the closest
+// preceding node if it is not this node's successor.
+func (c *Chord) findSuccessor(ctx context.Context, id uint64, hops int) (PeerInfo, error) {
+	c.mu.RLock()
+	succ, ok := c.successorLocked()
+	if !ok {
+		c.mu.RUnlock()
+		return c.adv.Info(c.selfID), nil
+	}
+	if between(id, ringID(c.selfID), ringID(succ.NodeID)) {
+		c.mu.RUnlock()
+		return succ, nil
+	}
+	next, ok := c.closestPrecedingLocked(id)
+	c.mu.RUnlock()
+	if !ok {
+		return succ, nil
+	}
+	if hops >= maxLookupHops {
+		return PeerInfo{}, fmt.Errorf("lookup for %016x took %d hops", id, hops)
+	}
+	return c.askSuccessor(ctx, next, id, hops+1)
+}
+
+func (c *Chord) askSuccessor(ctx context.Context, peer PeerInfo, id uint64, hops int) (PeerInfo, error) {
+	ctx, cancel := withRPCTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	var result PeerInfo
+	err := getJSON(ctx, fmt.Sprintf("http://%s/chord/find_successor?id=%016x&hops=%d", peer.Address, id, hops), &result)
+	if err == nil && result.NodeID == "" {
+		err = errors.New("empty find_successor response")
+	}
+	return result, err
+}
+
+func (c *Chord) fetchState(ctx context.Context, peer PeerInfo) (ChordState, error) {
+	ctx, cancel := withRPCTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	var state ChordState
+	err := getJSON(ctx, fmt.Sprintf("http://%s/chord/state", peer.Address), &state)
+	if err == nil && state.Node.NodeID != peer.NodeID {
+		err = fmt.Errorf("expected node %s, found %s", peer.NodeID, state.Node.NodeID)
+	}
+	return state, err
+}
+
+func (c *Chord) sendNotify(ctx context.Context, peer PeerInfo) error {
+	ctx, cancel := withRPCTimeout(ctx, c.rpcTimeout)
+	defer cancel()
+	buf, _ := json.Marshal(c.adv.Info(c.selfID))
+	req, err := newPeerRequest(ctx, http.MethodPost, fmt.Sprintf("http://%s/chord/notify", peer.Address), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// notify records that p believes it is this node's predecessor. A node that
+// is alone also takes p as its successor, which closes a ring of two.
+func (c *Chord) notify(p PeerInfo) {
+	if p.NodeID == c.selfID {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.predecessor == nil || betweenOpen(ringID(p.NodeID), ringID(c.predecessor.NodeID), ringID(c.selfID)) {
+		slog.Info("new chord predecessor", "component", "chord", "peer_id", p.NodeID, "peer_addr", p.Address)
+		c.predecessor = &p
+	}
+	if len(c.successors) == 0 {
+		c.successors = []PeerInfo{p}
+	}
+}
+
+// join takes a successor from a lookup of this node's ID, made through a
+// random peer from the routing table.
+func (c *Chord) join(ctx context.Context) {
+	peers := c.pl.Others(c.selfID)
+	rand.Shuffle(len(peers), func(a, b int) { peers[a], peers[b] = peers[b], peers[a] })
+	for _, p := range peers {
+		succ, err := c.askSuccessor(ctx, p, ringID(c.selfID), 0)
+		if err != nil {
+			slog.Debug("chord join lookup failed", "component", "chord", "via", p.Address, "err", err)
+			continue
+		}
+		if succ.NodeID == c.selfID {
+			continue
+		}
+		c.mu.Lock()
+		if len(c.successors) == 0 {
+			c.successors = []PeerInfo{succ}
+			slog.Info("joined chord ring", "component", "chord", "via", p.Address, "successor", succ.NodeID)
+		}
+		c.mu.Unlock()
+		return
+	}
+}
+
+// stabilize checks the successor, adopts the successor's predecessor if it
+// sits between the two, refreshes the successor list from the successor,
+// and notifies the successor of this node.
+func (c *Chord) stabilize(ctx context.Context) {
+	var succ PeerInfo
+	var state ChordState
+	for {
+		c.mu.RLock()
+		if len(c.successors) == 0 {
+			c.mu.RUnlock()
+			return
+		}
+		succ = c.successors[0]
+		c.mu.RUnlock()
+		var err error
+		if state, err = c.fetchState(ctx, succ); err == nil {
+			break
+		}
+		slog.Warn("chord successor not answering, dropped", "component", "chord", "peer_id", succ.NodeID, "peer_addr", succ.Address, "err", err)
+		c.mu.Lock()
+		if len(c.successors) > 0 && c.successors[0].NodeID == succ.NodeID {
+			c.successors = c.successors[1:]
+		}
+		c.mu.Unlock()
+	}
+	if x := state.Predecessor; x != nil && x.NodeID != c.selfID && betweenOpen(ringID(x.NodeID), ringID(c.selfID), ringID(succ.NodeID)) {
+		if xState, err := c.fetchState(ctx, *x); err == nil {
+			succ, state = *x, xState
+		}
+	}
+
+	// The successor's list, up to this node: in a ring smaller than the
+	// list, what follows is this node's own list coming round again
+	list := []PeerInfo{succ}
+	for _, s := range state.Successors {
+		if len(list) == c.successorN || s.NodeID == c.selfID {
+			break
+		}
+		list = append(list, s)
+	}
+	c.mu.Lock()
+	if len(c.successors) == 0 || c.successors[0].NodeID != succ.NodeID {
+		slog.Info("new chord successor", "component", "chord", "peer_id", succ.NodeID, "peer_addr", succ.Address)
+	}
+	c.successors = list
+	c.mu.Unlock()
+	c.pl.Add(succ)
+	c.pl.MarkSeen(succ.NodeID)
+
+	if err := c.sendNotify(ctx, succ); err != nil {
+		slog.Debug("chord notify failed", "component", "chord", "peer_id", succ.NodeID, "err", err)
+	}
+}
+
+// fixFingers refreshes the next fingersPerRound finger table entries.
+func (c *Chord) fixFingers(ctx context.Context) {
+	self := ringID(c.selfID)
+	for range fingersPerRound {
+		c.mu.Lock()
+		i := c.nextFinger
+		c.nextFinger = (i + 1) % ringBits
+		c.mu.Unlock()
+		succ, err := c.findSuccessor(ctx, self+1<<i, 0)
+		if err != nil {
+			slog.Debug("chord finger lookup failed", "component", "chord", "finger", i, "err", err)
+			continue
+		}
+		c.mu.Lock()
+		if succ.NodeID == c.selfID {
+			c.fingers[i] = nil
+		} else {
+			c.fingers[i] = &succ
+		}
+		c.mu.Unlock()
+	}
+}
+
+// checkPredecessor clears the predecessor if it does not answer a ping, so
+// that the next node to notify this one can take its place.
+func (c *Chord) checkPredecessor(ctx context.Context) {
+	c.mu.RLock()
+	pred := c.predecessor
+	c.mu.RUnlock()
+	if pred == nil {
+		return
+	}
+	pingCtx, cancel := withRPCTimeout(ctx, c.rpcTimeout)
+	pong, err := pingPeer(pingCtx, pred.Address)
+	cancel()
+	if err == nil && pong.NodeID == pred.NodeID {
+		c.pl.Add(*pred)
+		c.pl.MarkSeen(pred.NodeID)
+		return
+	}
+	slog.Warn("chord predecessor not answering, cleared", "component", "chord", "peer_id", pred.NodeID, "err", err)
+	c.mu.Lock()
+	if c.predecessor == pred {
+		c.predecessor = nil
+	}
+	c.mu.Unlock()
+}
+
+// Run joins the ring when alone and runs the maintenance tasks every
+// interval, until ctx is done.
+func (c *Chord) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.RLock()
+		alone := len(c.successors) == 0
+		c.mu.RUnlock()
+		if alone {
+			c.join(ctx)
+		}
+		c.stabilize(ctx)
+		c.checkPredecessor(ctx)
+		c.fixFingers(ctx)
+	}
+}
+
+// State returns this node's view of the ring. Consecutive fingers pointing
+// at the same node are listed once, under the first of them.
+func (c *Chord) State() ChordState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	state := ChordState{Node: c.adv.Info(c.selfID), Predecessor: c.predecessor, Successors: append([]PeerInfo{}, c.successors...)}
+	self := ringID(c.selfID)
+	for i, f := range c.fingers {
+		if f == nil || (len(state.Fingers) > 0 && state.Fingers[len(state.Fingers)-1].Node.NodeID == f.NodeID) {
+			continue
+		}
+		state.Fingers = append(state.Fingers, ChordFinger{Index: i, Start: fmt.Sprintf("%016x", self+1<<i), Node: *f})
+	}
+	return state
+}
+
+// chordStateHandler handles GET /chord/state.
+func chordStateHandler(c *Chord) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.State())
+	}
+}
+
+// chordNotifyHandler handles POST /chord/notify from a node that believes it
+// is this node's predecessor.
+func chordNotifyHandler(c *Chord) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var p PeerInfo
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&p); err != nil || p.NodeID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if p.Address == "" && len(p.Addresses) > 0 {
+			p.Address = p.Addresses[0].HostPort()
+		}
+		c.notify(p)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// chordFindSuccessorHandler handles GET /chord/find_successor?id=<hex>,
+// returning the node responsible for the ring position id.
+func chordFindSuccessorHandler(c *Chord) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 16, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hops, _ := strconv.Atoi(r.URL.Query().Get("hops"))
+		succ, err := c.findSuccessor(r.Context(), id, hops)
+		if err != nil {
+			logging.RequestLogger(r.Context()).Warn("find_successor failed", "id", fmt.Sprintf("%016x", id), "err", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(succ)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, a, b uint64
+		want    bool
+	}{
+		{"inside", 5, 1, 9, true},
+		{"upper bound included", 9, 1, 9, true},
+		{"lower bound excluded", 1, 1, 9, false},
+		{"below", 0, 1, 9, false},
+		{"above", 10, 1, 9, false},
+		{"wrapped, before zero", 0xf000000000000000, 9, 1, true},
+		{"wrapped, after zero", 0, 9, 1, true},
+		{"wrapped, upper bound included", 1, 9, 1, true},
+		{"wrapped, lower bound excluded", 9, 9, 1, false},
+		{"wrapped, outside", 5, 9, 1, false},
+		{"whole ring", 5, 7, 7, true},
+		{"whole ring, at the bound", 7, 7, 7, true},
+	}
+	for _, tt := range tests {
+		if got := between(tt.x, tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: between(%#x, %#x, %#x) = %v, want %v", tt.name, tt.x, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestBetweenOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, a, b uint64
+		want    bool
+	}{
+		{"inside", 5, 1, 9, true},
+		{"upper bound excluded", 9, 1, 9, false},
+		{"lower bound excluded", 1, 1, 9, false},
+		{"above", 10, 1, 9, false},
+		{"wrapped, before zero", 0xf000000000000000, 9, 1, true},
+		{"wrapped, after zero", 0, 9, 1, true},
+		{"wrapped, upper bound excluded", 1, 9, 1, false},
+		{"wrapped, outside", 5, 9, 1, false},
+		{"whole ring but the bound", 5, 7, 7, true},
+		{"whole ring, at the bound", 7, 7, 7, false},
+	}
+	for _, tt := range tests {
+		if got := betweenOpen(tt.x, tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: betweenOpen(%#x, %#x, %#x) = %v, want %v", tt.name, tt.x, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestChordNextHop(t *testing.T) {
+	n1 := PeerInfo{NodeID: "1000000000000000", Address: "127.0.0.1:1001"}
+	n9 := PeerInfo{NodeID: "9000000000000000", Address: "127.0.0.1:1009"}
+	nd := PeerInfo{NodeID: "d000000000000000", Address: "127.0.0.1:1013"}
+	c := newChord("5000000000000000", nil, NewPeerList(), defaultChordSuccessors, 0, 0)
+	c.predecessor = &n1
+	c.successors = []PeerInfo{n9, nd}
+	c.fingers[0] = &n9
+	c.fingers[63] = &nd
+
+	tests := []struct {
+		name string
+		key  string
+		want string // "" for this node
+	}{
+		{"after the predecessor", "3000000000000000", ""},
+		{"at this node", "5000000000000000", ""},
+		{"at the predecessor", "1000000000000000", "d000000000000000"},
+		{"up to the successor", "7000000000000000", "9000000000000000"},
+		{"at the successor", "9000000000000000", "9000000000000000"},
+		{"past the successor", "e000000000000000", "d000000000000000"},
+		{"past zero", "0800000000000000", "d000000000000000"},
+	}
+	for _, tt := range tests {
+		peer, isSelf := c.NextHop(tt.key)
+		if got := peer.NodeID; isSelf != (tt.want == "") || got != tt.want {
+			t.Errorf("%s: NextHop(%s) = %q, %v, want %q", tt.name, tt.key, got, isSelf, tt.want)
+		}
+	}
+
+	// Keys of a successor whose breaker is open go to the next one
+	openBreakers(t, n9.Address)
+	if peer, isSelf := c.NextHop("7000000000000000"); isSelf || peer.NodeID != nd.NodeID {
+		t.Errorf("with the successor failing, NextHop = %q, %v, want %q", peer.NodeID, isSelf, nd.NodeID)
+	}
+}
+
+func TestChordNextHopAlone(t *testing.T) {
+	c := newChord("5000000000000000", nil, NewPeerList(), defaultChordSuccessors, 0, 0)
+	for _, key := range []string{"0000000000000000", "5000000000000000", "f000000000000000"} {
+		if peer, isSelf := c.NextHop(key); !isSelf {
+			t.Errorf("alone, NextHop(%s) = %q, want this node", key, peer.NodeID)
+		}
+	}
+}
+
+func TestChordStabilize(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string // in ring order
+	}{
+		{"two nodes", []string{"1000000000000000", "9000000000000000"}},
+		{"three nodes", []string{"1000000000000000", "5000000000000000", "9000000000000000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := newTestCluster(t, routingChord, tt.ids)
+			stabilizeRing(t, nodes)
+			for i, n := range nodes {
+				c := n.router.(*Chord)
+				state := c.State()
+				next, prev := nodes[(i+1)%len(nodes)], nodes[(i+len(nodes)-1)%len(nodes)]
+				if state.Predecessor == nil || state.Predecessor.NodeID != prev.id {
+					t.Errorf("node %s: predecessor %v, want %s", n.id, state.Predecessor, prev.id)
+				}
+				var want []string
+				for j := 1; j < len(nodes); j++ {
+					want = append(want, nodes[(i+j)%len(nodes)].id)
+				}
+				var got []string
+				for _, s := range state.Successors {
+					got = append(got, s.NodeID)
+				}
+				if len(got) == 0 || got[0] != next.id || len(got) != len(want) {
+					t.Errorf("node %s: successors %v, want %v", n.id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChordNotify(t *testing.T) {
+	p1 := PeerInfo{NodeID: "1000000000000000", Address: "127.0.0.1:1001"}
+	p3 := PeerInfo{NodeID: "3000000000000000", Address: "127.0.0.1:1003"}
+	p7 := PeerInfo{NodeID: "7000000000000000", Address: "127.0.0.1:1007"}
+	c := newChord("5000000000000000", nil, NewPeerList(), defaultChordSuccessors, 0, 0)
+
+	// A node that is alone takes its first predecessor as its successor too
+	c.notify(p1)
+	if c.predecessor == nil || c.predecessor.NodeID != p1.NodeID {
+		t.Fatalf("predecessor %v, want %s", c.predecessor, p1.NodeID)
+	}
+	if len(c.successors) != 1 || c.successors[0].NodeID != p1.NodeID {
+		t.Fatalf("successors %v, want [%s]", c.successors, p1.NodeID)
+	}
+
+	// A closer predecessor replaces it, a farther one does not
+	c.notify(p3)
+	c.notify(p7)
+	c.notify(p1)
+	if c.predecessor.NodeID != p3.NodeID {
+		t.Errorf("predecessor %s, want %s", c.predecessor.NodeID, p3.NodeID)
+	}
+	if len(c.successors) != 1 || c.successors[0].NodeID != p1.NodeID {
+		t.Errorf("successors %v, want [%s]", c.successors, p1.NodeID)
+	}
+
+	// This node never becomes its own predecessor
+	c.notify(PeerInfo{NodeID: c.selfID, Address: "127.0.0.1:1005"})
+	if c.predecessor.NodeID != p3.NodeID {
+		t.Errorf("after notifying self, predecessor %s, want %s", c.predecessor.NodeID, p3.NodeID)
+	}
+}
+
+// stabilizeRing joins every node but the first through it, the way a lookup
+// through a node that is alone does, and runs stabilize until the ring has
+// had time to settle.
+func stabilizeRing(t *testing.T, nodes []*testNode) {
+	t.Helper()
+	first := nodes[0].adv.Info(nodes[0].id)
+	for _, n := range nodes[1:] {
+		n.router.(*Chord).successors = []PeerInfo{first}
+	}
+	for range len(nodes) + 1 {
+		for _, n := range nodes {
+			n.router.(*Chord).stabilize(context.Background())
+		}
+	}
+}
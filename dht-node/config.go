@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dht-multiaddr"
+	"dht-pex"
+	"dht-swim"
+)
+
+// defaultK is the number of closest peers returned by /find_node.
+const defaultK = 3
+
+// Config holds everything dht-node can be configured with. Values are
+// layered: built-in defaults, then the JSON config file, then DHT_*
+// environment variables, then command-line flags. Every option has one name
+// used in all layers: "max-hops" is the flag --max-hops, the config file key
+// "max_hops" and the environment variable DHT_MAX_HOPS.
+type Config struct {
+	Addr                string
+	AdvertiseAddr       []string
+	Bootstrap           []string
+	K                   int
+	Routing             string
+	Placement           string
+	PlacementVnodes     int
+	ChordSuccessors     int
+	ChordStabilize      time.Duration
+	DataDir             string
+	StoreFile           string
+	RoutingSaveInterval time.Duration
+	JoinBackoff         time.Duration
+	JoinBackoffMax      time.Duration
+	RejoinAfter         time.Duration
+	BootstrapRefresh    time.Duration
+	Discovery           bool
+	DiscoveryGroup      string
+	DiscoveryPort       int
+	DiscoveryInterval   time.Duration
+	NetworkID           string
+	PexInterval         time.Duration
+	PexSampleSize       int
+	PexMergeRate        int
+	SwimInterval        time.Duration
+	SwimPingTimeout     time.Duration
+	SwimIndirect        int
+	SwimSuspectTimeout  time.Duration
+	MaxHops             int
+	RequestTimeout      time.Duration
+	RPCTimeout          time.Duration
+	PeerMaxInFlight     int
+	BreakerThreshold    int
+	BreakerCooldown     time.Duration
+	LogLevel            string
+	LogFormat           string
+}
+
+// configSources maps each option name to where its effective value came from.
+type configSources map[string]string
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:                ":8080",
+		K:                   defaultK,
+		Routing:             routingKademlia,
+		Placement:           placementXOR,
+		PlacementVnodes:     defaultPlacementVnodes,
+		ChordSuccessors:     defaultChordSuccessors,
+		ChordStabilize:      defaultChordStabilizeInterval,
+		RoutingSaveInterval: defaultRoutingSaveInterval,
+		JoinBackoff:         defaultJoinBackoff,
+		JoinBackoffMax:      defaultJoinBackoffMax,
+		RejoinAfter:         defaultRejoinAfter,
+		BootstrapRefresh:    defaultBootstrapRefresh,
+		DiscoveryGroup:      defaultDiscoveryGroup,
+		DiscoveryPort:       defaultDiscoveryPort,
+		DiscoveryInterval:   defaultDiscoveryInterval,
+		NetworkID:           defaultNetworkID,
+		PexInterval:         pex.DefaultInterval,
+		PexSampleSize:       pex.DefaultSampleSize,
+		PexMergeRate:        pex.DefaultMergeRate,
+		SwimInterval:        swim.DefaultInterval,
+		SwimPingTimeout:     swim.DefaultPingTimeout,
+		SwimIndirect:        swim.DefaultIndirect,
+		SwimSuspectTimeout:  swim.DefaultSuspectTimeout,
+		MaxHops:             defaultMaxHops,
+		RequestTimeout:      defaultRequestTimeout,
+		RPCTimeout:          defaultRPCTimeout,
+		PeerMaxInFlight:     defaultPeerMaxInFlight,
+		BreakerThreshold:    defaultBreakerThreshold,
+		BreakerCooldown:     defaultBreakerCooldown,
+		LogLevel:            "info",
+		LogFormat:           "text",
+	}
+}
+
+// bind registers a flag for every option on fs, backed by the fields of c.
+// The config file and environment layers are applied through the same flag
+// values, so all three layers parse values the same way.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "Listen address (host:port); may also be given as the first argument")
+	fs.Var((*listValue)(&c.AdvertiseAddr), "advertise-addr", "Comma-separated addresses (host:port or /ip4/<ip>/tcp/<port>) to give peers, most preferred first (default: learned from peers when listening on all interfaces)")
+	fs.Var((*listValue)(&c.Bootstrap), "bootstrap", "Comma-separated bootstrap node addresses (host:port or multiaddr-style), tried in random order")
+	fs.IntVar(&c.K, "k", c.K, "Number of closest peers returned by /find_node")
+	fs.StringVar(&c.Routing, "routing", c.Routing, "Routing overlay for put/get: kademlia or chord (all nodes must use the same)")
+	fs.StringVar(&c.Placement, "placement", c.Placement, "Kademlia: how the node responsible for a key is chosen: xor, consistent or rendezvous (all nodes must use the same)")
+	fs.IntVar(&c.PlacementVnodes, "placement-vnodes", c.PlacementVnodes, "Kademlia: ring points per node for consistent placement")
+	fs.IntVar(&c.ChordSuccessors, "chord-successors", c.ChordSuccessors, "Chord: length of the successor list")
+	fs.DurationVar(&c.ChordStabilize, "chord-stabilize-interval", c.ChordStabilize, "Chord: how often to run stabilize, fix_fingers and check_predecessor")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Data directory (default data_<listen-address hash> in the working directory)")
+	fs.StringVar(&c.StoreFile, "store-file", c.StoreFile, "Store file (default store.json in the data directory)")
+	fs.DurationVar(&c.RoutingSaveInterval, "routing-save-interval", c.RoutingSaveInterval, "How often the routing table is saved to the data directory")
+	fs.DurationVar(&c.JoinBackoff, "join-backoff", c.JoinBackoff, "Wait before retrying when no bootstrap node could be joined; doubles on every retry")
+	fs.DurationVar(&c.JoinBackoffMax, "join-backoff-max", c.JoinBackoffMax, "Longest wait between join retries")
+	fs.DurationVar(&c.RejoinAfter, "rejoin-after", c.RejoinAfter, "Rejoin the network after having no reachable peer for this long")
+	fs.DurationVar(&c.BootstrapRefresh, "bootstrap-refresh", c.BootstrapRefresh, "How often to register again with the bootstrap nodes (rendezvous nodes forget peers that stop)")
+	fs.BoolVar(&c.Discovery, "discovery", c.Discovery, "Find peers on the LAN through multicast announcements")
+	fs.StringVar(&c.DiscoveryGroup, "discovery-group", c.DiscoveryGroup, "Multicast group (IP) for LAN discovery")
+	fs.IntVar(&c.DiscoveryPort, "discovery-port", c.DiscoveryPort, "UDP port for LAN discovery")
+	fs.DurationVar(&c.DiscoveryInterval, "discovery-interval", c.DiscoveryInterval, "How often this node announces itself for LAN discovery")
+	fs.StringVar(&c.NetworkID, "network-id", c.NetworkID, "Network ID; LAN discovery ignores nodes announcing a different one")
+	fs.DurationVar(&c.PexInterval, "pex-interval", c.PexInterval, "How often to exchange a sample of the routing table with a random peer (0 disables peer exchange)")
+	fs.IntVar(&c.PexSampleSize, "pex-sample-size", c.PexSampleSize, "Peers sent in a peer exchange; larger samples received are cut to this size")
+	fs.IntVar(&c.PexMergeRate, "pex-merge-rate", c.PexMergeRate, "Unknown peers from peer exchanges pinged and added per minute, at most")
+	fs.DurationVar(&c.SwimInterval, "swim-interval", c.SwimInterval, "How often the failure detector probes a peer (0 disables failure detection)")
+	fs.DurationVar(&c.SwimPingTimeout, "swim-ping-timeout", c.SwimPingTimeout, "Wait for a probed peer's answer before asking other peers to probe it")
+	fs.IntVar(&c.SwimIndirect, "swim-indirect", c.SwimIndirect, "Peers asked to probe a peer that did not answer a direct probe")
+	fs.DurationVar(&c.SwimSuspectTimeout, "swim-suspect-timeout", c.SwimSuspectTimeout, "How long a suspected peer has to refute the suspicion before it is confirmed dead and evicted")
+	fs.IntVar(&c.MaxHops, "max-hops", c.MaxHops, "Maximum number of times a request may be forwarded")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "Deadline for a client request, including all forwarding hops")
+	fs.DurationVar(&c.RPCTimeout, "rpc-timeout", c.RPCTimeout, "Timeout for a single call to a peer made by the node itself (join, cluster key listing)")
+	fs.IntVar(&c.PeerMaxInFlight, "peer-max-inflight", c.PeerMaxInFlight, "Maximum concurrent requests to a single peer")
+	fs.IntVar(&c.BreakerThreshold, "breaker-threshold", c.BreakerThreshold, "Consecutive failures before a peer's circuit breaker opens")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", c.BreakerCooldown, "Time between probes of a peer with an open circuit breaker")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (debug, info, warn, error)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log output format (text, json)")
+}
+
+// listValue is a comma-separated list option. Setting it replaces the whole
+// list, so a later layer overrides an earlier one rather than adding to it.
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable for an option name.
+func envName(option string) string {
+	return "DHT_" + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// loadConfig builds the effective configuration from the command-line
+// arguments (without the program name). printOnly is set by --print-config.
+func loadConfig(args []string) (cfg *Config, sources configSources, printOnly bool, err error) {
+	// First pass: parse the command line on its own to find the config file
+	// and remember which options were given as flags
+	fs := flag.NewFlagSet("dht-node", flag.ExitOnError)
+	defaultConfig().bind(fs)
+	var configFile string
+	fs.StringVar(&configFile, "config", "", "JSON config file (or DHT_CONFIG; default config.json in --data-dir if present)")
+	fs.BoolVar(&printOnly, "print-config", false, "Print the effective configuration and where each value came from, then exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: dht-node [flags] [addr]\n\nOptions can also be set in the config file (key max_hops for --max-hops)\nor the environment (DHT_MAX_HOPS); flags take precedence over both.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	if configFile == "" {
+		configFile = os.Getenv("DHT_CONFIG")
+	}
+	if configFile == "" {
+		// The data directory may hold the config file, so it can only be
+		// chosen by flag or environment
+		dataDir, ok := flags["data-dir"]
+		if !ok {
+			dataDir = os.Getenv(envName("data-dir"))
+		}
+		if path := filepath.Join(dataDir, configFileName); dataDir != "" && fileExists(path) {
+			configFile = path
+		}
+	}
+
+	// Second pass: apply the layers in order to a fresh config
+	cfg = defaultConfig()
+	layers := flag.NewFlagSet("dht-node", flag.ContinueOnError)
+	layers.SetOutput(io.Discard)
+	cfg.bind(layers)
+	sources = make(configSources)
+	layers.VisitAll(func(f *flag.Flag) { sources[f.Name] = "default" })
+
+	if configFile != "" {
+		if err := applyConfigFile(layers, sources, configFile); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	var errs []error
+	layers.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("environment %s: invalid value %q", env, v))
+				return
+			}
+			sources[f.Name] = "env " + env
+		}
+	})
+	if len(errs) > 0 {
+		return nil, nil, false, errors.Join(errs...)
+	}
+	for name, v := range flags {
+		layers.Set(name, v) // already parsed once, cannot fail
+		sources[name] = "flag --" + name
+	}
+	if fs.NArg() > 0 {
+		layers.Set("addr", fs.Arg(0))
+		sources["addr"] = "argument"
+	}
+	return cfg, sources, printOnly, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// applyConfigFile sets the options found in a JSON config file. Keys are
+// option names with underscores, values are strings, numbers, booleans or,
+// for list options, arrays of strings.
+func applyConfigFile(fs *flag.FlagSet, sources configSources, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	var errs []error
+	for key, raw := range values {
+		f := fs.Lookup(strings.ReplaceAll(key, "_", "-"))
+		if f == nil {
+			errs = append(errs, fmt.Errorf("config file %s: unknown option %q", path, key))
+			continue
+		}
+		v := string(raw)
+		var s string
+		var list []string
+		if json.Unmarshal(raw, &s) == nil {
+			v = s
+		} else if json.Unmarshal(raw, &list) == nil {
+			v = strings.Join(list, ",")
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: invalid value %s", path, key, raw))
+			continue
+		}
+		sources[f.Name] = "file " + path
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the configuration, naming the source of every bad value.
+func (c *Config) validate(sources configSources) error {
+	var errs []error
+	check := func(ok bool, option, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s (from %s)", option, fmt.Sprintf(format, args...), sources[option]))
+		}
+	}
+	check(c.Addr != "", "addr", "must not be empty")
+	for _, a := range c.Bootstrap {
+		_, err := multiaddr.Parse(a)
+		check(err == nil, "bootstrap", "must be host:port or /ip4|ip6|dns/<host>/tcp/<port>, got %q", a)
+	}
+	for _, a := range c.AdvertiseAddr {
+		_, err := multiaddr.Parse(a)
+		check(err == nil, "advertise-addr", "must be host:port or /ip4|ip6|dns/<host>/tcp/<port>, got %q", a)
+	}
+	check(c.K >= 1, "k", "must be at least 1, got %d", c.K)
+	check(c.Routing == routingKademlia || c.Routing == routingChord, "routing", "must be kademlia or chord, got %q", c.Routing)
+	check(slices.Contains(placementNames, c.Placement), "placement", "must be one of %s, got %q", strings.Join(placementNames, ", "), c.Placement)
+	check(c.Placement == placementXOR || c.Routing == routingKademlia, "placement", "only applies to kademlia routing, got %q with %s", c.Placement, c.Routing)
+	check(c.PlacementVnodes >= 1 && c.PlacementVnodes <= maxPlacementVnodes, "placement-vnodes", "must be between 1 and %d, got %d", maxPlacementVnodes, c.PlacementVnodes)
+	check(c.ChordSuccessors >= 1, "chord-successors", "must be at least 1, got %d", c.ChordSuccessors)
+	check(c.ChordStabilize > 0, "chord-stabilize-interval", "must be positive, got %s", c.ChordStabilize)
+	check(c.RoutingSaveInterval > 0, "routing-save-interval", "must be positive, got %s", c.RoutingSaveInterval)
+	check(c.JoinBackoff > 0, "join-backoff", "must be positive, got %s", c.JoinBackoff)
+	check(c.JoinBackoffMax >= c.JoinBackoff, "join-backoff-max", "must be at least join-backoff (%s), got %s", c.JoinBackoff, c.JoinBackoffMax)
+	check(c.RejoinAfter >= minRejoinAfter, "rejoin-after", "must be at least %s, got %s", minRejoinAfter, c.RejoinAfter)
+	check(c.BootstrapRefresh > 0, "bootstrap-refresh", "must be positive, got %s", c.BootstrapRefresh)
+	group := net.ParseIP(c.DiscoveryGroup)
+	check(group != nil && group.IsMulticast(), "discovery-group", "must be a multicast IP address, got %q", c.DiscoveryGroup)
+	check(c.DiscoveryPort >= 1 && c.DiscoveryPort <= 65535, "discovery-port", "must be a port number, got %d", c.DiscoveryPort)
+	check(c.DiscoveryInterval > 0, "discovery-interval", "must be positive, got %s", c.DiscoveryInterval)
+	check(c.NetworkID != "", "network-id", "must not be empty")
+	check(c.PexInterval >= 0, "pex-interval", "must not be negative, got %s", c.PexInterval)
+	check(c.PexSampleSize >= 1 && c.PexSampleSize <= pex.MaxSampleSize, "pex-sample-size", "must be between 1 and %d, got %d", pex.MaxSampleSize, c.PexSampleSize)
+	check(c.PexMergeRate >= 1, "pex-merge-rate", "must be at least 1, got %d", c.PexMergeRate)
+	check(c.SwimInterval >= 0, "swim-interval", "must not be negative, got %s", c.SwimInterval)
+	check(c.SwimPingTimeout > 0 && (c.SwimInterval == 0 || c.SwimPingTimeout < c.SwimInterval), "swim-ping-timeout", "must be positive and shorter than swim-interval (%s), got %s", c.SwimInterval, c.SwimPingTimeout)
+	check(c.SwimIndirect >= 0, "swim-indirect", "must not be negative, got %d", c.SwimIndirect)
+	check(c.SwimSuspectTimeout > 0, "swim-suspect-timeout", "must be positive, got %s", c.SwimSuspectTimeout)
+	check(c.MaxHops >= 1, "max-hops", "must be at least 1, got %d", c.MaxHops)
+	check(c.RequestTimeout > hopReserve, "request-timeout", "must be longer than %s, got %s", hopReserve, c.RequestTimeout)
+	check(c.RPCTimeout > 0, "rpc-timeout", "must be positive, got %s", c.RPCTimeout)
+	check(c.PeerMaxInFlight >= 1, "peer-max-inflight", "must be at least 1, got %d", c.PeerMaxInFlight)
+	check(c.BreakerThreshold >= 1, "breaker-threshold", "must be at least 1, got %d", c.BreakerThreshold)
+	check(c.BreakerCooldown > 0, "breaker-cooldown", "must be positive, got %s", c.BreakerCooldown)
+	var lvl slog.Level
+	check(lvl.UnmarshalText([]byte(c.LogLevel)) == nil, "log-level", "must be debug, info, warn or error, got %q", c.LogLevel)
+	format := strings.ToLower(c.LogFormat)
+	check(format == "text" || format == "json", "log-format", "must be text or json, got %q", c.LogFormat)
+	return errors.Join(errs...)
+}
+
+// printConfig writes every option with its effective value and source.
+func printConfig(w io.Writer, c *Config, sources configSources) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.bind(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "%-22s %-24q %s\n", f.Name, f.Value.String(), sources[f.Name])
+	})
+}
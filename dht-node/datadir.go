@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dataLayoutVersion is the version of the data directory layout written by
+// this dht-node. A directory with any other version is refused.
+const dataLayoutVersion = 1
+
+// Files in the data directory.
+const (
+	versionFileName  = "VERSION"
+	lockFileName     = "LOCK"
+	identityFileName = "identity.key"
+	storeFileName    = "store.json"
+	configFileName   = "config.json"
+)
+
+// DataDir is a node's data directory. It holds the layout version marker,
+// the lock file, the identity key, the store and optionally config.json.
+// While open it is locked so a second instance cannot use it.
+type DataDir struct {
+	Path string
+	lock *os.File
+}
+
+// openDataDir opens or creates the data directory at path, takes its lock
+// and checks the layout version. An empty or new directory is initialized.
+func openDataDir(path string) (*DataDir, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+	lock, err := lockFile(filepath.Join(path, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("data directory %s: %w", path, err)
+	}
+	d := &DataDir{Path: path, lock: lock}
+	if err := d.checkVersion(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// File returns the path of a file in the data directory.
+func (d *DataDir) File(name string) string {
+	return filepath.Join(d.Path, name)
+}
+
+// Close releases the lock.
+func (d *DataDir) Close() error {
+	return unlockFile(d.lock)
+}
+
+func (d *DataDir) checkVersion() error {
+	data, err := os.ReadFile(d.File(versionFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err := os.ReadDir(d.Path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name() != lockFileName {
+				return fmt.Errorf("%s is not empty and has no %s file, so it is not a dht-node data directory", d.Path, versionFileName)
+			}
+		}
+		return os.WriteFile(d.File(versionFileName), []byte(strconv.Itoa(dataLayoutVersion)+"\n"), 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	v := strings.TrimSpace(string(data))
+	if v != strconv.Itoa(dataLayoutVersion) {
+		return fmt.Errorf("data directory %s has layout version %q, this dht-node only supports version %d", d.Path, v, dataLayoutVersion)
+	}
+	return nil
+}
+
+// migrateLegacyStore moves a store file written by older versions
+// (store_<listen-address hash>.json in the working directory) to dst in the
+// data directory, unless dst already exists.
+func (d *DataDir) migrateLegacyStore(legacy, dst string) error {
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		slog.Warn("legacy store file ignored, data directory already has a store", "legacy", legacy, "store", dst)
+		return nil
+	}
+	if err := os.Rename(legacy, dst); err != nil {
+		// Rename fails across file systems; copy instead
+		if err := copyFile(legacy, dst); err != nil {
+			return fmt.Errorf("migrating %s: %w", legacy, err)
+		}
+		if err := os.Remove(legacy); err != nil {
+			return fmt.Errorf("migrating %s: %w", legacy, err)
+		}
+	}
+	slog.Info("migrated legacy store file into data directory", "from", legacy, "to", dst)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Identity returns the node's ed25519 identity key, generating and saving
+// it on first use.
+func (d *DataDir) Identity() (ed25519.PrivateKey, error) {
+	path := d.File(identityFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, block, 0o600); err != nil {
+			return nil, err
+		}
+		slog.Info("generated identity key", "file", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht-logging"
+	"dht-pex"
+	"dht-swim"
+)
+
+// deadlineHeader carries the time left for a forwarded request in
+// milliseconds, so each hop works within what remains of the client's budget.
+const deadlineHeader = "X-DHT-Deadline"
+
+// hopReserve is kept back by a forwarding node so it can still answer its
+// caller when the next hop runs out of time.
+const hopReserve = 50 * time.Millisecond
+
+const (
+	defaultRequestTimeout = 10 * time.Second
+	defaultRPCTimeout     = 3 * time.Second
+)
+
+// withDeadline bounds a request by timeout, or by the budget a forwarding
+// peer passed in deadlineHeader if that is shorter. The request context is
+// also cancelled when the client disconnects, which cancels any calls the
+// handler makes to peers in turn.
+func withDeadline(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		budget := timeout
+		if ms, err := strconv.ParseInt(r.Header.Get(deadlineHeader), 10, 64); err == nil && ms > 0 {
+			budget = min(budget, time.Duration(ms)*time.Millisecond)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// errRPCTimeout is the cause of a context that ran out of its per-peer RPC
+// timeout, as opposed to the deadline inherited from the client's request.
+var errRPCTimeout = errors.New("peer RPC timeout")
+
+// withRPCTimeout bounds a call to a peer by timeout. A call that runs out of
+// this time counts against the peer's circuit breaker; one that runs out of
+// the caller's own budget first does not.
+func withRPCTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, timeout, errRPCTimeout)
+}
+
+// peerFault reports whether a failed call made with ctx says something about
+// the peer: it failed on its own, or within the per-peer RPC timeout, SWIM
+// probe timeout or peer exchange timeout. A client that went away or a request budget that ran out
+// does not.
+func peerFault(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return ctx.Err() == nil || errors.Is(cause, errRPCTimeout) || errors.Is(cause, swim.ErrProbeTimeout) || errors.Is(cause, pex.ErrExchangeTimeout)
+}
+
+// peerContext derives the context for a forwarded call from the request
+// context, keeping hopReserve of the deadline back for this node.
+func peerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dl, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, dl.Add(-hopReserve))
+	}
+	return context.WithCancel(ctx)
+}
+
+// newPeerRequest builds a request to a peer bound to ctx. It passes on the
+// request ID and the time left before ctx expires.
+func newPeerRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	setPeerDeadline(req)
+	logging.SetRequestID(ctx, req)
+	return req, nil
+}
+
+// setPeerDeadline passes the time left in the context of req to the peer.
+func setPeerDeadline(req *http.Request) {
+	if dl, ok := req.Context().Deadline(); ok {
+		req.Header.Set(deadlineHeader, strconv.FormatInt(time.Until(dl).Milliseconds(), 10))
+	}
+}
+
+// forwardErrorStatus returns the status to report when a call to a peer failed.
+func forwardErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
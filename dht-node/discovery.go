@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dht-multiaddr"
+)
+
+const (
+	defaultDiscoveryGroup    = "239.255.77.77"
+	defaultDiscoveryPort     = 7946
+	defaultDiscoveryInterval = 5 * time.Second
+	defaultNetworkID         = "dht"
+
+	// announcementMaxAge is how far an announcement's time may be from ours.
+	// Older announcements are dropped as replays; the margin also allows for
+	// clock skew between hosts.
+	announcementMaxAge  = time.Minute
+	maxAnnouncementSize = 2048
+
+	// maxDiscoveryChecks bounds the liveness checks started per interval, and
+	// with them the nodes remembered as recently checked.
+	maxDiscoveryChecks = 256
+)
+
+// Announcement is the message a node multicasts to make itself known on the
+// LAN. It is signed with the node's identity key.
+type Announcement struct {
+	NetworkID string            `json:"network_id"`
+	NodeID    string            `json:"node_id"`
+	Addresses []multiaddr.Addr  `json:"addresses"`
+	Time      int64             `json:"time"` // Unix milliseconds
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Signature []byte            `json:"signature"`
+}
+
+// signedBytes returns the part of the announcement covered by the signature.
+func (a *Announcement) signedBytes() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "dht-announce\n%s\n%s\n%d\n", a.NetworkID, a.NodeID, a.Time)
+	for _, addr := range a.Addresses {
+		b.WriteString(addr.String())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// Discovery multicasts announcements for this node and listens for those of
+// other nodes with the same network ID. A node it hears from is added to the
+// routing table once it answers a ping with the announced node ID.
+type Discovery struct {
+	group      *net.UDPAddr
+	interval   time.Duration
+	networkID  string
+	selfID     string
+	key        ed25519.PrivateKey
+	adv        *Advertised
+	pl         *PeerList
+	rpcTimeout time.Duration
+
+	mu      sync.Mutex
+	checked map[string]time.Time // node ID -> last liveness check, within the last interval
+}
+
+func newDiscovery(group string, port int, interval time.Duration, networkID, selfID string, key ed25519.PrivateKey, adv *Advertised, pl *PeerList, rpcTimeout time.Duration) *Discovery {
+	return &Discovery{
+		group:      &net.UDPAddr{IP: net.ParseIP(group), Port: port},
+		interval:   interval,
+		networkID:  networkID,
+		selfID:     selfID,
+		key:        key,
+		adv:        adv,
+		pl:         pl,
+		rpcTimeout: rpcTimeout,
+		checked:    make(map[string]time.Time),
+	}
+}
+
+// Run announces and listens until ctx is done. It fails if the multicast
+// group cannot be joined.
+func (d *Discovery) Run(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp", nil, d.group)
+	if err != nil {
+		return fmt.Errorf("joining multicast group %s: %w", d.group, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	slog.Info("LAN discovery enabled", "group", d.group, "network_id", d.networkID)
+	go d.announce(ctx)
+
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		d.handle(ctx, buf[:n], src)
+	}
+}
+
+// announce sends an announcement now and then every interval.
+func (d *Discovery) announce(ctx context.Context) {
+	conn, err := net.DialUDP("udp", nil, d.group)
+	if err != nil {
+		slog.Error("cannot send discovery announcements", "group", d.group, "err", err)
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		a := Announcement{
+			NetworkID: d.networkID,
+			NodeID:    d.selfID,
+			Addresses: d.adv.All(),
+			Time:      time.Now().UnixMilli(),
+			PublicKey: d.key.Public().(ed25519.PublicKey),
+		}
+		a.Signature = ed25519.Sign(d.key, a.signedBytes())
+		data, _ := json.Marshal(a)
+		if _, err := conn.Write(data); err != nil {
+			slog.Warn("failed to send discovery announcement", "group", d.group, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handle checks an announcement and, if its node needs a liveness check,
+// starts one.
+func (d *Discovery) handle(ctx context.Context, data []byte, src *net.UDPAddr) {
+	var a Announcement
+	if err := json.Unmarshal(data, &a); err != nil {
+		slog.Debug("dropping malformed announcement", "from", src, "err", err)
+		return
+	}
+	if a.NetworkID != d.networkID || a.NodeID == d.selfID || len(a.Addresses) == 0 {
+		return
+	}
+	if err := d.verify(&a); err != nil {
+		slog.Debug("dropping announcement", "from", src, "node_id", a.NodeID, "err", err)
+		return
+	}
+	// Besides the announced addresses, try the host the announcement came
+	// from, which is reachable even if the node only knows its loopback
+	// address
+	candidates := multiaddr.HostPorts(a.Addresses)
+	fromSource := net.JoinHostPort(src.IP.String(), strconv.Itoa(a.Addresses[0].Port))
+	if !slices.Contains(candidates, fromSource) {
+		candidates = append(candidates, fromSource)
+	}
+	if !d.due(a.NodeID, candidates) {
+		return
+	}
+	go d.check(ctx, a.NodeID, candidates)
+}
+
+// verify checks the signature and age of an announcement, and that its node
+// ID is the one derived from its key, so no other key can claim it.
+func (d *Discovery) verify(a *Announcement) error {
+	if len(a.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(a.PublicKey, a.signedBytes(), a.Signature) {
+		return errors.New("bad signature")
+	}
+	if a.NodeID != nodeID(a.PublicKey) {
+		return errors.New("node ID does not match the key")
+	}
+	if age := time.Since(time.UnixMilli(a.Time)); age > announcementMaxAge || age < -announcementMaxAge {
+		return fmt.Errorf("time is off by %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+// due reports whether the announced node should be checked: it is not in the
+// routing table at one of the candidate addresses, it was not checked in the
+// last interval, and fewer than maxDiscoveryChecks other nodes were.
+func (d *Discovery) due(nodeID string, candidates []string) bool {
+	if p, ok := d.pl.Get(nodeID); ok && slices.Contains(candidates, p.Address) {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, t := range d.checked {
+		if time.Since(t) >= d.interval {
+			delete(d.checked, id)
+		}
+	}
+	if _, ok := d.checked[nodeID]; ok || len(d.checked) >= maxDiscoveryChecks {
+		return false
+	}
+	d.checked[nodeID] = time.Now()
+	return true
+}
+
+// check pings the announced node at each candidate address in turn and adds
+// it to the routing table at the first one that answers with its node ID.
+func (d *Discovery) check(ctx context.Context, nodeID string, candidates []string) {
+	for _, addr := range candidates {
+		if addIfLive(ctx, PeerInfo{NodeID: nodeID, Address: addr}, d.adv, d.pl, d.rpcTimeout) {
+			slog.Info("discovered peer on the LAN", "peer_id", nodeID, "peer_addr", addr)
+			return
+		}
+	}
+	slog.Debug("announced peer did not answer", "peer_id", nodeID, "tried", candidates)
+}
@@ -1,3 +1,23 @@
 module dht-node
 
 go 1.24.3
+
+require (
+	dht-advertise v0.0.0
+	dht-logging v0.0.0
+	dht-metrics v0.0.0
+	dht-multiaddr v0.0.0
+	dht-pex v0.0.0
+	dht-swim v0.0.0
+	dht-version v0.0.0
+)
+
+replace (
+	dht-advertise => ../dht-advertise
+	dht-logging => ../dht-logging
+	dht-metrics => ../dht-metrics
+	dht-multiaddr => ../dht-multiaddr
+	dht-pex => ../dht-pex
+	dht-swim => ../dht-swim
+	dht-version => ../dht-version
+)
@@ -2,26 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-)
+	"strconv"
+	"time"
 
-func logRequest(handlerName string, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] %s called: %s %s", handlerName, r.Method, r.URL.Path)
-		next(w, r)
-	}
-}
+	"dht-logging"
+	"dht-version"
+)
 
-func pingHandler(nodeID, address string) http.HandlerFunc {
+func pingHandler(nodeID string, adv *Advertised) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp := PeerInfo{NodeID: nodeID, Address: address}
+		resp := PingResponse{PeerInfo: adv.Info(nodeID), ObservedAddr: observedAddr(r)}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
@@ -36,144 +34,290 @@ func peersHandler(pl *PeerList) http.HandlerFunc {
 
 func registerHandler(pl *PeerList) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] /register called: %s %s", r.Method, r.URL.Path)
+		logger := logging.RequestLogger(r.Context())
 		var peer PeerInfo
-		if err := json.NewDecoder(r.Body).Decode(&peer); err == nil {
-			log.Printf("[HANDLER] /register received peer: %+v", peer)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegisterMessageSize)).Decode(&peer); err == nil {
+			logger.Info("peer registered", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 			pl.Add(peer)
+			pl.MarkSeen(peer.NodeID)
 			logPeerList(pl, "/register END")
-			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(RegisterResponse{Status: "registered", ObservedAddr: observedAddr(r)})
 		} else {
-			log.Printf("[HANDLER] /register decode error: %v", err)
+			logger.Warn("register decode error", "err", err)
 			w.WriteHeader(http.StatusBadRequest)
 		}
 	}
 }
 
-func findNodeHandler(pl *PeerList, selfID string) http.HandlerFunc {
+func findNodeHandler(pl *PeerList, selfID string, k int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[HANDLER] /find_node called: %s %s", r.Method, r.URL.Path)
 		target := r.URL.Query().Get("target")
 		if target == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		closest := pl.closestPeers(target, 3, selfID)
-		log.Printf("[HANDLER] /find_node for target %s: returning %d peers", target, len(closest))
+		closest := pl.closestPeers(target, k, selfID)
+		logging.RequestLogger(r.Context()).Info("find_node", "target", target, "returned", len(closest))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(closest)
 	}
 }
 
 type PutRequest struct {
-	Key   string `json:"key,omitempty"`
-	Name  string `json:"name,omitempty"`
-	Value string `json:"value"`
+	Key       string              `json:"key,omitempty"`
+	Name      string              `json:"name,omitempty"`
+	Value     string              `json:"value"`
+	Version   version.VectorClock `json:"version"`
+	Condition *version.Condition  `json:"condition,omitempty"`
 }
 
 type PutResponse struct {
-	Key string `json:"key"`
+	Key     string              `json:"key"`
+	Version version.VectorClock `json:"version"`
+	Trace   []TraceHop          `json:"trace,omitempty"`
 }
 
-type GetResponse struct {
+// ErrorResponse is the body of a put refused by the node storing the key.
+type ErrorResponse struct {
 	Key   string `json:"key"`
-	Value string `json:"value"`
-	Found bool   `json:"found"`
+	Error string `json:"error"`
+}
+
+type GetResponse struct {
+	Key      string              `json:"key"`
+	Value    string              `json:"value"`
+	Version  version.VectorClock `json:"version,omitempty"`
+	Siblings []version.Versioned `json:"siblings,omitempty"`
+	Found    bool                `json:"found"`
+	Trace    []TraceHop          `json:"trace,omitempty"`
+}
+
+type KeysResponse struct {
+	Keys        []KeyInfo `json:"keys"`
+	NextCursor  string    `json:"next_cursor,omitempty"`
+	Unreachable []string  `json:"unreachable,omitempty"` // peers that failed in cluster mode
+}
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+type ReplicateRequest struct {
+	Key string `json:"key"`
+	version.Versioned
+}
+
+// newGetResponse builds a GetResponse, listing siblings only when they conflict.
+func newGetResponse(key string, siblings []version.Versioned) GetResponse {
+	resp := GetResponse{Key: key, Found: true, Version: version.MergedClock(siblings)}
+	if len(siblings) == 1 {
+		resp.Value = base64.StdEncoding.EncodeToString(siblings[0].Value)
+	} else {
+		resp.Siblings = siblings
+	}
+	return resp
+}
+
+// contentKey returns the key to use for a request: the explicit key, or SHA-1 of the name.
+func contentKey(key, name string) string {
+	if key == "" && name != "" {
+		h := sha1.Sum([]byte(name))
+		key = hex.EncodeToString(h[:])
+	}
+	return key
+}
+
+// storeLocal validates and stores a PutRequest in the local store. It returns
+// the response, the HTTP status to report, and an error message if the status is not 200.
+func storeLocal(ctx context.Context, store *Store, key string, req PutRequest) (PutResponse, int, string) {
+	logger := logging.RequestLogger(ctx)
+	val, err := base64.StdEncoding.DecodeString(req.Value)
+	if err != nil || key == "" || (req.Condition != nil && (req.Version != nil || req.Condition.Empty())) {
+		return PutResponse{Key: key}, http.StatusBadRequest, "invalid put request"
+	}
+	logger.Info("storing key locally (self is closest)", "key", key)
+	var clock version.VectorClock
+	if req.Condition != nil {
+		clock, err = store.PutIf(key, val, *req.Condition)
+	} else {
+		clock, err = store.Put(key, val, req.Version)
+	}
+	if errors.Is(err, ErrConflict) {
+		logger.Info("put rejected: version conflict", "key", key)
+		return PutResponse{Key: key}, http.StatusConflict, "version does not match current value"
+	}
+	if errors.Is(err, version.ErrPreconditionFailed) {
+		logger.Info("put rejected: precondition failed", "key", key)
+		return PutResponse{Key: key}, http.StatusPreconditionFailed, "condition does not hold for current value"
+	}
+	if err != nil {
+		return PutResponse{Key: key}, http.StatusInternalServerError, err.Error()
+	}
+	return PutResponse{Key: key, Version: clock}, http.StatusOK, ""
 }
 
 // putContentHandler handles POST /put for storing content in the DHT.
-func putContentHandler(store *Store, pl *PeerList, selfID string) http.HandlerFunc {
+func putContentHandler(store *Store, router Router, selfID string, adv *Advertised, maxHops int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req PutRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		key := req.Key
-		if key == "" && req.Name != "" {
-			h := sha1.Sum([]byte(req.Name))
-			key = hex.EncodeToString(h[:])
-		}
-		val, err := base64.StdEncoding.DecodeString(req.Value)
-		if err != nil || key == "" {
+		key := contentKey(req.Key, req.Name)
+		if key == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		logger := logging.RequestLogger(r.Context())
+		start := time.Now()
+		rt := incomingRoute(r)
+		tr := newTracer(r, router, selfID, adv.Primary(), key)
 		// Find the closest peer to the key (including self)
-		closest := pl.closestPeers(key, 1, "")
-		isSelfClosest := len(closest) == 0 || closest[0].NodeID == selfID
+		peer, isSelfClosest, err := nextHop(router, rt, key, maxHops)
+		if err != nil {
+			writeRoutingError(w, r, key, selfID, rt, err)
+			return
+		}
 		if isSelfClosest {
-			log.Printf("[DHT] Storing key %s locally (self is closest)", key)
-			if err := store.Put(key, val); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			resp, status, msg := storeLocal(r.Context(), store, key, req)
+			observeLookup(r, "put", rt.hops, start)
+			w.Header().Set(hopsHeader, strconv.Itoa(rt.hops))
+			if status != http.StatusOK {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(ErrorResponse{Key: key, Error: msg})
 				return
 			}
+			tr.record(&resp, decisionLocal)
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(PutResponse{Key: key})
+			json.NewEncoder(w).Encode(resp)
 			return
 		}
-		// Forward to closest peer
-		peer := closest[0]
-		log.Printf("[DHT] Forwarding PUT for key %s to peer %s at %s", key, peer.NodeID, peer.Address)
-		forwardReq := PutRequest{Key: req.Key, Name: req.Name, Value: req.Value}
+		// Forward to closest peer, including any condition so it is checked where the data lives
+		logger.Info("forwarding put", "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
+		forwardReq := PutRequest{Key: req.Key, Name: req.Name, Value: req.Value, Version: req.Version, Condition: req.Condition}
 		buf, _ := json.Marshal(forwardReq)
-		url := fmt.Sprintf("http://%s/put", peer.Address)
-		resp, err := http.Post(url, "application/json", bytes.NewReader(buf))
+		respHops, err := forwardRequest(r.Context(), w, http.MethodPost, fmt.Sprintf("http://%s/put", peer.Address), bytes.NewReader(buf), rt.forward(selfID), tr, &PutResponse{})
 		if err != nil {
-			log.Printf("[DHT] Failed to forward PUT to %s: %v", peer.Address, err)
-			w.WriteHeader(http.StatusBadGateway)
+			logger.Warn("failed to forward put", "peer_addr", peer.Address, "err", err)
+			rpcErrors.Record(peer.Address)
+			w.WriteHeader(forwardErrorStatus(err))
 			return
 		}
-		defer resp.Body.Close()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		forwardedRequests.Inc("put")
+		observeLookup(r, "put", respHops, start)
 	}
 }
 
 // getContentHandler handles GET /get for retrieving content from the DHT.
-func getContentHandler(store *Store, pl *PeerList, selfID string) http.HandlerFunc {
+func getContentHandler(store *Store, router Router, selfID string, adv *Advertised, maxHops int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		name := r.URL.Query().Get("name")
-		if key == "" && name != "" {
-			h := sha1.Sum([]byte(name))
-			key = hex.EncodeToString(h[:])
-		}
+		key := contentKey(r.URL.Query().Get("key"), r.URL.Query().Get("name"))
 		if key == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		val, ok := store.Get(key)
+		logger := logging.RequestLogger(r.Context())
+		start := time.Now()
+		rt := incomingRoute(r)
+		tr := newTracer(r, router, selfID, adv.Primary(), key)
+		siblings, ok := store.Get(key)
 		if ok {
-			log.Printf("[DHT] GET key %s found locally", key)
-			resp := GetResponse{Key: key, Value: base64.StdEncoding.EncodeToString(val), Found: true}
+			logger.Info("get found locally", "key", key, "siblings", len(siblings))
+			observeLookup(r, "get", rt.hops, start)
+			w.Header().Set(hopsHeader, strconv.Itoa(rt.hops))
+			resp := newGetResponse(key, siblings)
+			tr.record(&resp, decisionLocal)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
 		// Not found locally: find closest peer and forward
-		closest := pl.closestPeers(key, 1, "")
-		isSelfClosest := len(closest) == 0 || closest[0].NodeID == selfID
+		peer, isSelfClosest, err := nextHop(router, rt, key, maxHops)
+		if err != nil {
+			writeRoutingError(w, r, key, selfID, rt, err)
+			return
+		}
 		if isSelfClosest {
-			log.Printf("[DHT] GET key %s not found locally and self is closest", key)
+			logger.Info("get not found locally and self is closest", "key", key)
+			observeLookup(r, "get", rt.hops, start)
+			w.Header().Set(hopsHeader, strconv.Itoa(rt.hops))
 			resp := GetResponse{Key: key, Found: false}
+			tr.record(&resp, decisionNotFound)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
-		peer := closest[0]
-		log.Printf("[DHT] Forwarding GET for key %s to peer %s at %s", key, peer.NodeID, peer.Address)
+		logger.Info("forwarding get", "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
 		url := fmt.Sprintf("http://%s/get?key=%s", peer.Address, key)
-		resp, err := http.Get(url)
+		respHops, err := forwardRequest(r.Context(), w, http.MethodGet, url, nil, rt.forward(selfID), tr, &GetResponse{})
 		if err != nil {
-			log.Printf("[DHT] Failed to forward GET to %s: %v", peer.Address, err)
-			w.WriteHeader(http.StatusBadGateway)
+			logger.Warn("failed to forward get", "peer_addr", peer.Address, "err", err)
+			rpcErrors.Record(peer.Address)
+			w.WriteHeader(forwardErrorStatus(err))
 			return
 		}
-		defer resp.Body.Close()
+		forwardedRequests.Inc("get")
+		observeLookup(r, "get", respHops, start)
+	}
+}
+
+// replicateHandler handles POST /replicate, merging a versioned value pushed by another replica.
+func replicateHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReplicateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		siblings, err := store.Merge(req.Key, req.Versioned)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logging.RequestLogger(r.Context()).Info("merged replica", "key", req.Key, "siblings", len(siblings))
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		json.NewEncoder(w).Encode(newGetResponse(req.Key, siblings))
+	}
+}
+
+// keysHandler handles GET /keys. With scope=cluster the same page is requested
+// from every known peer and the results are merged.
+func keysHandler(store *Store, pl *PeerList, selfID string, rpcTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := defaultKeysLimit
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxKeysLimit)
+		}
+		prefix, cursor := q.Get("prefix"), q.Get("cursor")
+		withMeta := q.Get("meta") == "true"
+		keys, next := store.Keys(prefix, cursor, limit, withMeta)
+		resp := KeysResponse{Keys: keys, NextCursor: next}
+		if q.Get("scope") == "cluster" {
+			pages := []KeysResponse{resp}
+			var unreachable []string
+			for _, res := range fetchClusterKeys(r.Context(), pl.Others(selfID), prefix, cursor, limit, withMeta, rpcTimeout) {
+				if res.err != nil {
+					logging.RequestLogger(r.Context()).Warn("keys request failed on peer", "peer_addr", res.peer.Address, "err", res.err)
+					rpcErrors.Record(res.peer.Address)
+					unreachable = append(unreachable, res.peer.Address)
+					continue
+				}
+				pages = append(pages, res.page)
+			}
+			keys, next = mergeKeyPages(pages, limit)
+			resp = KeysResponse{Keys: keys, NextCursor: next, Unreachable: unreachable}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
 	}
 }
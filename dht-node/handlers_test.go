@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"dht-version"
+)
+
+// responsible returns the node of a Kademlia cluster responsible for key, and
+// another node that forwards requests for it.
+func responsible(t *testing.T, nodes []*testNode, key string) (owner, other *testNode) {
+	t.Helper()
+	for _, n := range nodes {
+		if _, isSelf := n.router.NextHop(key); isSelf {
+			owner = n
+		} else {
+			other = n
+		}
+	}
+	if owner == nil || other == nil {
+		t.Fatalf("no owner and forwarding node for %s", key)
+	}
+	return owner, other
+}
+
+// postPut posts a raw /put body and returns the status.
+func postPut(t *testing.T, n *testNode, body string) int {
+	t.Helper()
+	resp, err := http.Post(n.srv.URL+"/put", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// postBatchPut posts a raw /batch/put body and returns the status of each item.
+func postBatchPut(t *testing.T, n *testNode, body string) []int {
+	t.Helper()
+	resp, err := http.Post(n.srv.URL+"/batch/put", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var statuses []int
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var result BatchPutResult
+		if err := json.Unmarshal(sc.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, result.Status)
+	}
+	return statuses
+}
+
+func TestForwardedCreateOnlyPut(t *testing.T) {
+	nodes := newTestCluster(t, routingKademlia, []string{"1000000000000000", "5000000000000000", "9000000000000000"})
+	key := "9100000000000000"
+	owner, other := responsible(t, nodes, key)
+	putKey(t, owner, key, "first")
+
+	// An empty version means the key must not exist, also when forwarded
+	if status := postPut(t, other, `{"key":"`+key+`","value":"c2Vjb25k","version":{}}`); status != http.StatusConflict {
+		t.Errorf("forwarded create-only put of an existing key: status %d, want %d", status, http.StatusConflict)
+	}
+	if got := postBatchPut(t, other, `{"items":[{"key":"`+key+`","value":"c2Vjb25k","version":{}}]}`); len(got) != 1 || got[0] != http.StatusConflict {
+		t.Errorf("forwarded create-only batch put of an existing key: statuses %v, want [%d]", got, http.StatusConflict)
+	}
+	if got, _ := getKey(t, other, key); got != "first" {
+		t.Errorf("value after refused puts = %q, want %q", got, "first")
+	}
+
+	// A new key is created
+	if status := postPut(t, other, `{"key":"9200000000000000","value":"c2Vjb25k","version":{}}`); status != http.StatusOK {
+		t.Errorf("forwarded create-only put of a new key: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestForwardedEmptyVersionCondition(t *testing.T) {
+	nodes := newTestCluster(t, routingKademlia, []string{"1000000000000000", "5000000000000000", "9000000000000000"})
+	key := "9100000000000000"
+	owner, other := responsible(t, nodes, key)
+	putKey(t, owner, key, "first")
+
+	// if_version {} only holds while the key does not exist
+	if status := postPut(t, other, `{"key":"`+key+`","value":"c2Vjb25k","condition":{"if_version":{}}}`); status != http.StatusPreconditionFailed {
+		t.Errorf("forwarded if_version {} put of an existing key: status %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	if status := postPut(t, other, `{"key":"`+key+`","value":"c2Vjb25k","condition":{}}`); status != http.StatusBadRequest {
+		t.Errorf("forwarded put with an empty condition: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if got, _ := getKey(t, other, key); got != "first" {
+		t.Errorf("value after refused puts = %q, want %q", got, "first")
+	}
+}
+
+// getVersion returns the JSON of the current version of key.
+func getVersion(t *testing.T, n *testNode, key string) string {
+	t.Helper()
+	resp, err := http.Get(n.srv.URL + "/get?key=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result GetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(result.Version)
+	return string(buf)
+}
+
+// TestConditionalPut checks every kind of precondition, sent to the node
+// responsible for the key and forwarded by another node. Each case writes
+// "zero", then "first" unless the key should be missing, and puts "second"
+// with the case's version or condition.
+func TestConditionalPut(t *testing.T) {
+	nodes := newTestCluster(t, routingKademlia, []string{"1000000000000000", "5000000000000000", "9000000000000000"})
+	hash := func(s string) string { return `"` + version.HashValue([]byte(s)) + `"` }
+	tests := []struct {
+		name    string
+		missing bool
+		put     string // $current is the current version, $stale the version before "first"
+		want    int
+	}{
+		{"current version", false, `"version":$current`, http.StatusOK},
+		{"stale version", false, `"version":$stale`, http.StatusConflict},
+		{"if_version current", false, `"condition":{"if_version":$current}`, http.StatusOK},
+		{"if_version stale", false, `"condition":{"if_version":$stale}`, http.StatusPreconditionFailed},
+		{"if_hash current", false, `"condition":{"if_hash":` + hash("first") + `}`, http.StatusOK},
+		{"if_hash stale", false, `"condition":{"if_hash":` + hash("zero") + `}`, http.StatusPreconditionFailed},
+		{"if_absent present", false, `"condition":{"if_absent":true}`, http.StatusPreconditionFailed},
+		{"if_absent missing", true, `"condition":{"if_absent":true}`, http.StatusOK},
+		{"if_present present", false, `"condition":{"if_present":true}`, http.StatusOK},
+		{"if_present missing", true, `"condition":{"if_present":true}`, http.StatusPreconditionFailed},
+		{"version and condition", false, `"version":$current,"condition":{"if_present":true}`, http.StatusBadRequest},
+	}
+	for _, via := range []string{"owner", "forwarded"} {
+		for i, tt := range tests {
+			key := fmt.Sprintf("91000000000000%02x", i)
+			if via == "forwarded" {
+				key = fmt.Sprintf("92000000000000%02x", i)
+			}
+			owner, other := responsible(t, nodes, key)
+			n := owner
+			if via == "forwarded" {
+				n = other
+			}
+			stale := "{}"
+			if !tt.missing {
+				putKey(t, owner, key, "zero")
+				stale = getVersion(t, owner, key)
+				putKey(t, owner, key, "first")
+			}
+			current := getVersion(t, owner, key)
+			body := `{"key":"` + key + `","value":"c2Vjb25k",` + strings.NewReplacer("$current", current, "$stale", stale).Replace(tt.put) + `}`
+			if status := postPut(t, n, body); status != tt.want {
+				t.Errorf("%s, %s: status %d, want %d", via, tt.name, status, tt.want)
+			}
+			want := "first"
+			if tt.missing {
+				want = ""
+			}
+			if tt.want == http.StatusOK {
+				want = "second"
+			}
+			if got, _ := getKey(t, owner, key); got != want {
+				t.Errorf("%s, %s: value %q, want %q", via, tt.name, got, want)
+			}
+		}
+	}
+}
+
+// TestPutErrorBody checks that a refused put says why, also when forwarded.
+func TestPutErrorBody(t *testing.T) {
+	nodes := newTestCluster(t, routingKademlia, []string{"1000000000000000", "5000000000000000", "9000000000000000"})
+	key := "9100000000000000"
+	owner, other := responsible(t, nodes, key)
+	putKey(t, owner, key, "first")
+	tests := []struct {
+		body   string
+		status int
+		error  string
+	}{
+		{`{"key":"` + key + `","value":"c2Vjb25k","version":{}}`, http.StatusConflict, "version does not match current value"},
+		{`{"key":"` + key + `","value":"c2Vjb25k","condition":{"if_absent":true}}`, http.StatusPreconditionFailed, "condition does not hold for current value"},
+		{`{"key":"` + key + `","value":"c2Vjb25k","condition":{}}`, http.StatusBadRequest, "invalid put request"},
+	}
+	for _, n := range []*testNode{owner, other} {
+		for _, tt := range tests {
+			resp, err := http.Post(n.srv.URL+"/put", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body ErrorResponse
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || err != nil || body.Key != key || body.Error != tt.error {
+				t.Errorf("put %s through %s: %d %+v (%v), want %d with error %q", tt.body, n.id, resp.StatusCode, body, err, tt.status, tt.error)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJoinBackoff    = time.Second
+	defaultJoinBackoffMax = time.Minute
+	defaultRejoinAfter    = 30 * time.Second
+	// Isolation is checked every third of --rejoin-after by pinging peers,
+	// so shorter settings are refused
+	minRejoinAfter = time.Second
+	// Rendezvous nodes expire registrations after a few minutes
+	defaultBootstrapRefresh = time.Minute
+)
+
+// Join states reported on /status.
+const (
+	joinIdle    = "idle"    // no join has been needed yet
+	joinJoining = "joining" // trying a bootstrap node
+	joinWaiting = "waiting" // every bootstrap node failed, backing off
+	joinJoined  = "joined"
+)
+
+// joinProgress tracks the current or last join for /status.
+var joinProgress = &joinTracker{status: JoinStatus{State: joinIdle}}
+
+// JoinStatus is the join progress reported on /status.
+type JoinStatus struct {
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`            // failed attempts since the join started
+	Bootstrap string    `json:"bootstrap,omitempty"` // node being tried, or joined through
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry,omitzero"`
+	JoinedAt  time.Time `json:"joined_at,omitzero"`
+	Rejoins   int       `json:"rejoins"` // joins started by the watchdog
+}
+
+type joinTracker struct {
+	mu     sync.Mutex
+	status JoinStatus
+}
+
+func (jt *joinTracker) update(fn func(s *JoinStatus)) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	fn(&jt.status)
+}
+
+// Snapshot returns the current join status.
+func (jt *joinTracker) Snapshot() JoinStatus {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	return jt.status
+}
+
+// joiner joins the network through a list of bootstrap nodes and rejoins
+// when the node becomes isolated.
+type joiner struct {
+	bootstrap   []string
+	adv         *Advertised
+	selfID      string
+	pl          *PeerList
+	rpcTimeout  time.Duration
+	backoff     time.Duration // wait after the first failed round
+	maxBackoff  time.Duration
+	rejoinAfter time.Duration
+}
+
+// candidates returns the addresses to join through: the configured bootstrap
+// nodes in random order, then every known peer in random order. The node's
+// own address is skipped so one bootstrap list can be shared by all nodes.
+func (j *joiner) candidates() []string {
+	addrs := slices.DeleteFunc(slices.Clone(j.bootstrap), j.adv.Has)
+	rand.Shuffle(len(addrs), func(a, b int) { addrs[a], addrs[b] = addrs[b], addrs[a] })
+	peers := j.pl.Others(j.selfID)
+	rand.Shuffle(len(peers), func(a, b int) { peers[a], peers[b] = peers[b], peers[a] })
+	for _, p := range peers {
+		if !slices.Contains(addrs, p.Address) {
+			addrs = append(addrs, p.Address)
+		}
+	}
+	return addrs
+}
+
+// join tries the candidates until a join succeeds. After a round in which
+// all of them failed it waits with exponential backoff and jitter and tries
+// again. It reports false if ctx ends first.
+func (j *joiner) join(ctx context.Context) bool {
+	defer jobs.Start("join")()
+	joinProgress.update(func(s *JoinStatus) { s.State, s.Attempts, s.LastError = joinJoining, 0, "" })
+	delay := j.backoff
+	for {
+		for _, addr := range j.candidates() {
+			joinProgress.update(func(s *JoinStatus) { s.State, s.Bootstrap, s.NextRetry = joinJoining, addr, time.Time{} })
+			err := joinNetwork(ctx, addr, j.selfID, j.adv, j.pl, j.rpcTimeout)
+			if err == nil {
+				joinProgress.update(func(s *JoinStatus) { s.State, s.JoinedAt = joinJoined, time.Now() })
+				return true
+			}
+			joinProgress.update(func(s *JoinStatus) { s.Attempts++; s.LastError = err.Error() })
+			if ctx.Err() != nil {
+				return false
+			}
+		}
+		// Equal jitter: wait between half and all of the current delay
+		wait := delay/2 + rand.N(delay/2+1)
+		joinLogger().Warn("no bootstrap node reachable, retrying", "in", wait)
+		joinProgress.update(func(s *JoinStatus) { s.State, s.NextRetry = joinWaiting, time.Now().Add(wait) })
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, j.maxBackoff)
+	}
+}
+
+// isolated reports whether no known peer answers a ping. Peers are tried in
+// random order until one answers; peers with an open circuit breaker are
+// skipped, and failed pings count towards opening theirs.
+func (j *joiner) isolated(ctx context.Context) bool {
+	peers := j.pl.Others(j.selfID)
+	rand.Shuffle(len(peers), func(a, b int) { peers[a], peers[b] = peers[b], peers[a] })
+	for _, p := range peers {
+		if !peerClient.Available(p.Address) {
+			continue
+		}
+		pingCtx, cancel := withRPCTimeout(ctx, j.rpcTimeout)
+		pong, err := pingPeer(pingCtx, p.Address)
+		cancel()
+		if err == nil && pong.NodeID == p.NodeID {
+			j.adv.Observe(p.NodeID, pong.ObservedAddr)
+			j.pl.MarkSeen(p.NodeID)
+			return false
+		}
+	}
+	return true
+}
+
+// watch rejoins the network whenever the node has been isolated for
+// rejoinAfter, until ctx is done.
+func (j *joiner) watch(ctx context.Context) {
+	ticker := time.NewTicker(j.rejoinAfter / 3)
+	defer ticker.Stop()
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !j.isolated(ctx) || len(j.candidates()) == 0 {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+			continue
+		}
+		if time.Since(since) < j.rejoinAfter {
+			continue
+		}
+		joinLogger().Warn("node is isolated, rejoining", "since", since)
+		joinProgress.update(func(s *JoinStatus) { s.Rejoins++ })
+		j.join(ctx)
+		since = time.Time{}
+	}
+}
+
+// refresh registers this node again with every configured bootstrap node
+// every interval, until ctx is done.
+func (j *joiner) refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, addr := range j.bootstrap {
+			if j.adv.Has(addr) {
+				continue
+			}
+			announceCtx, cancel := withRPCTimeout(ctx, j.rpcTimeout)
+			announceSelf(announceCtx, PeerInfo{Address: addr}, j.selfID, j.adv, j.pl)
+			cancel()
+		}
+	}
+}
+
+// run joins the network if there is anything to join through, then keeps
+// watching for isolation.
+func (j *joiner) run(ctx context.Context) {
+	if len(j.candidates()) > 0 {
+		j.join(ctx)
+	}
+	j.watch(ctx)
+}
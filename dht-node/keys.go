@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"dht-version"
+)
+
+// KeyInfo describes a stored key. Meta is only filled in when requested.
+type KeyInfo struct {
+	Key  string   `json:"key"`
+	Meta *KeyMeta `json:"meta,omitempty"`
+}
+
+// KeyMeta holds size and version information about a stored key.
+type KeyMeta struct {
+	Size     int                 `json:"size"` // size of the largest sibling in bytes
+	Siblings int                 `json:"siblings"`
+	Version  version.VectorClock `json:"version"`
+}
+
+// Keys returns up to limit keys with the given prefix that sort after the
+// cursor, in lexicographic order. The returned cursor is the last key of the
+// page, or empty if there are no more keys. Because the cursor is a key and
+// not an offset, pages stay consistent while other writes are happening.
+func (s *Store) Keys(prefix, cursor string, limit int, withMeta bool) ([]KeyInfo, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0)
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) && k > cursor {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	result := make([]KeyInfo, 0, len(keys))
+	for _, k := range keys {
+		info := KeyInfo{Key: k}
+		if withMeta {
+			info.Meta = keyMeta(s.data[k])
+		}
+		result = append(result, info)
+	}
+	return result, next
+}
+
+func keyMeta(siblings []version.Versioned) *KeyMeta {
+	meta := &KeyMeta{Siblings: len(siblings), Version: version.MergedClock(siblings)}
+	for _, s := range siblings {
+		if len(s.Value) > meta.Size {
+			meta.Size = len(s.Value)
+		}
+	}
+	return meta
+}
+
+// mergeKeyPages merges pages returned by several nodes into a single page of
+// at most limit keys. Keys held by more than one node are listed once.
+func mergeKeyPages(pages []KeysResponse, limit int) ([]KeyInfo, string) {
+	seen := make(map[string]KeyInfo)
+	more := false
+	for _, p := range pages {
+		for _, k := range p.Keys {
+			if _, ok := seen[k.Key]; !ok {
+				seen[k.Key] = k
+			}
+		}
+		if p.NextCursor != "" {
+			more = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+		more = true
+	}
+	result := make([]KeyInfo, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, seen[k])
+	}
+	next := ""
+	if more && len(keys) > 0 {
+		next = keys[len(keys)-1]
+	}
+	return result, next
+}
@@ -1,57 +1,229 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"dht-logging"
+	"dht-metrics"
+	"dht-multiaddr"
+	"dht-pex"
+	"dht-swim"
 )
 
 func main() {
-	var bootstrapAddr string
-	flag.StringVar(&bootstrapAddr, "bootstrap", "", "Bootstrap node address (host:port)")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "balance" {
+		if err := runBalance(os.Args[2:], os.Stdout); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(2)
+		}
+		return
+	}
+	cfg, sources, printOnly, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printOnly {
+		printConfig(os.Stdout, cfg, sources)
+		return
+	}
+	if err := cfg.validate(sources); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := run(cfg); err != nil {
+		slog.Error("node stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the node and serves until SIGINT or SIGTERM. It returns instead
+// of exiting so that deferred cleanup, such as releasing the data directory
+// lock, always happens.
+func run(cfg *Config) error {
+	peerClient = newPeerClient(cfg.PeerMaxInFlight, cfg.BreakerThreshold, cfg.BreakerCooldown)
 
-	addr := ":8080"
-	if flag.NArg() > 0 {
-		addr = flag.Arg(0)
+	// Cancelled on SIGINT/SIGTERM to shut down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	addr := cfg.Addr
+	adv, err := newAdvertised(addr, cfg.AdvertiseAddr)
+	if err != nil {
+		return fmt.Errorf("cannot determine advertised address: %w", err)
 	}
 
-	selfNodeID := generateNodeID(addr)
-	selfAddr := addr
-	if addr[0] == ':' {
-		selfAddr = "127.0.0.1" + addr
+	// Data directory: locked for this process, holds the identity key and store
+	dataDirPath := cfg.DataDir
+	if dataDirPath == "" {
+		dataDirPath = fmt.Sprintf("data_%s", addrID(addr))
+	}
+	dataDir, err := openDataDir(dataDirPath)
+	if err != nil {
+		return fmt.Errorf("cannot use data directory: %w", err)
 	}
+	defer dataDir.Close()
+	identity, err := dataDir.Identity()
+	if err != nil {
+		return fmt.Errorf("cannot load identity key: %w", err)
+	}
+	selfNodeID := nodeID(identity.Public().(ed25519.PublicKey))
 	pl := NewPeerList()
-	pl.Add(PeerInfo{NodeID: selfNodeID, Address: selfAddr})
+	pl.Add(adv.Info(selfNodeID))
 
 	// Content store setup
-	store := NewStore(selfNodeID)
+	storeFile := cfg.StoreFile
+	if storeFile == "" {
+		storeFile = dataDir.File(storeFileName)
+		if err := dataDir.migrateLegacyStore(fmt.Sprintf("store_%s.json", addrID(addr)), storeFile); err != nil {
+			return fmt.Errorf("cannot migrate legacy store: %w", err)
+		}
+	}
+	store := NewStore(storeFile, selfNodeID)
 	if err := store.Load(); err != nil {
-		log.Printf("[STORE] No existing store loaded: %v", err)
+		slog.Info("no existing store loaded", "err", err)
+	}
+
+	// Listen before joining: bootstrap and rendezvous nodes may ping back
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", addr, err)
 	}
 
-	if bootstrapAddr != "" {
-		joinNetwork(bootstrapAddr, selfAddr, selfNodeID, pl)
+	// Peers from the last run that are still alive rebuild the routing table
+	// and are tried after the configured bootstrap nodes
+	routingFile := dataDir.File(routingTableFileName)
+	restoreRoutingTable(ctx, routingFile, pl, selfNodeID, cfg.RPCTimeout)
+	var bootstrap []string
+	for _, b := range cfg.Bootstrap {
+		a, _ := multiaddr.Parse(b) // checked by validate
+		bootstrap = append(bootstrap, a.HostPort())
+	}
+	j := &joiner{
+		bootstrap:   bootstrap,
+		adv:         adv,
+		selfID:      selfNodeID,
+		pl:          pl,
+		rpcTimeout:  cfg.RPCTimeout,
+		backoff:     cfg.JoinBackoff,
+		maxBackoff:  cfg.JoinBackoffMax,
+		rejoinAfter: cfg.RejoinAfter,
+	}
+	go j.run(ctx)
+	if len(bootstrap) > 0 {
+		go j.refresh(ctx, cfg.BootstrapRefresh)
+	}
+	go reannounce(ctx, adv, selfNodeID, pl, cfg.RPCTimeout)
+	if cfg.Discovery {
+		disc := newDiscovery(cfg.DiscoveryGroup, cfg.DiscoveryPort, cfg.DiscoveryInterval, cfg.NetworkID, selfNodeID, identity, adv, pl, cfg.RPCTimeout)
+		go func() {
+			if err := disc.Run(ctx); err != nil {
+				slog.Error("LAN discovery stopped", "err", err)
+			}
+		}()
+	}
+	exchange := pex.New(pexTable{selfNodeID, adv, pl, cfg.RPCTimeout}, pexClient{}, cfg.PexSampleSize, cfg.PexMergeRate, cfg.RPCTimeout)
+	if cfg.PexInterval > 0 {
+		go exchange.Run(ctx, cfg.PexInterval)
+	}
+	var router Router
+	if cfg.Routing == routingChord {
+		router = newChord(selfNodeID, adv, pl, cfg.ChordSuccessors, cfg.ChordStabilize, cfg.RPCTimeout)
+	} else {
+		placement, _ := newPlacement(cfg.Placement, cfg.PlacementVnodes) // validated with the config
+		router = &Kademlia{selfID: selfNodeID, pl: pl, placement: placement}
+	}
+	go router.Run(ctx)
+	membership := swim.New(selfNodeID, swimTable{pl, selfNodeID}, swimClient{}, cfg.SwimPingTimeout, cfg.SwimIndirect, cfg.SwimSuspectTimeout)
+	if cfg.SwimInterval > 0 {
+		go membership.Run(ctx, cfg.SwimInterval)
 	}
+	go persistRoutingTable(ctx, routingFile, pl, selfNodeID, cfg.RoutingSaveInterval)
+	go prunePeerClient(ctx, pl, cfg.BreakerCooldown)
 
 	fmt.Printf("Node ID: %s\n", selfNodeID)
+	registerNodeMetrics(store, pl, selfNodeID)
 
-	http.HandleFunc("/ping", logRequest("/ping", pingHandler(selfNodeID, selfAddr)))
-	http.HandleFunc("/peers", logRequest("/peers", peersHandler(pl)))
-	http.HandleFunc("/register", registerHandler(pl))
-	http.HandleFunc("/find_node", logRequest("/find_node", findNodeHandler(pl, selfNodeID)))
+	// Every handler gets a request ID, a log line, request metrics and a deadline
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.HandleFunc(pattern, metrics.InstrumentHandler(pattern, logging.LogRequest(pattern, withDeadline(cfg.RequestTimeout, h))))
+	}
+	handle("/ping", pingHandler(selfNodeID, adv))
+	handle("/peers", peersHandler(pl))
+	handle("/register", registerHandler(pl))
+	handle("/find_node", findNodeHandler(pl, selfNodeID, cfg.K))
+	handle("/pex", pex.Handler(exchange))
+	handle("/swim/ping", swim.PingHandler(membership))
+	handle("/swim/ping-req", swim.PingReqHandler(membership))
+	if chord, ok := router.(*Chord); ok {
+		handle("/chord/state", chordStateHandler(chord))
+		handle("/chord/notify", chordNotifyHandler(chord))
+		handle("/chord/find_successor", chordFindSuccessorHandler(chord))
+	}
 	// Content endpoints
-	http.HandleFunc("/put", putContentHandler(store, pl, selfNodeID))
-	http.HandleFunc("/get", getContentHandler(store, pl, selfNodeID))
+	handle("/put", putContentHandler(store, router, selfNodeID, adv, cfg.MaxHops))
+	handle("/get", getContentHandler(store, router, selfNodeID, adv, cfg.MaxHops))
+	handle("/batch/put", batchPutHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("/batch/get", batchGetHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("/keys", keysHandler(store, pl, selfNodeID, cfg.RPCTimeout))
+	handle("GET /v1/objects/{key}", objectGetHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("PUT /v1/objects/{key}", objectPutHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("POST /v1/objects", objectPostHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("DELETE /v1/objects/{key}", objectDeleteHandler(store, router, selfNodeID, cfg.MaxHops))
+	handle("/status", statusHandler(store, pl, router, selfNodeID, adv, membership))
+	handle("/routing_table", routingTableHandler(pl, selfNodeID, membership))
+	handle("/replicate", replicateHandler(store))
+	http.HandleFunc("/metrics", metrics.Handler())
 
-	log.Printf("Listening on %s...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	srv := &http.Server{Addr: addr}
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	slog.Info("listening", "addr", addr)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server stopped: %w", err)
+	}
+	if err := saveRoutingTable(routingFile, pl, selfNodeID); err != nil {
+		slog.Error("failed to save routing table", "file", routingFile, "err", err)
+	}
+	return nil
+}
+
+// nodeID derives a node ID from an identity key: the first 8 bytes of the
+// SHA-1 of the public key, in hex. A node keeps its ID across restarts and
+// address changes, nodes started with the same address still differ, and
+// a signed announcement proves the ID it carries.
+func nodeID(key ed25519.PublicKey) string {
+	h := sha1.Sum(key)
+	return hex.EncodeToString(h[:8])
 }
 
-func generateNodeID(addr string) string {
+// addrID is what node IDs were derived from before the identity key: the
+// first 8 bytes of the SHA-1 of the listen address, in hex. It still names
+// the default data directory and the legacy store file.
+func addrID(addr string) string {
 	h := sha1.Sum([]byte(addr))
 	return hex.EncodeToString(h[:8])
 }
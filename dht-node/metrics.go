@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"dht-metrics"
+)
+
+// hopsHeader carries the number of forwarding hops a put/get has taken.
+// Forwarding nodes increment it, the node that answers echoes it back.
+const hopsHeader = "X-DHT-Hops"
+
+var (
+	forwardedRequests = metrics.NewCounter("dht_forwarded_requests_total",
+		"Requests forwarded to the responsible peer, by operation.", "op")
+	lookupHops = metrics.NewHistogram("dht_lookup_hops",
+		"Forwarding hops needed to resolve a client put/get, by operation.",
+		[]float64{0, 1, 2, 3, 4, 6, 8, 12}, "op")
+	lookupDuration = metrics.NewHistogram("dht_lookup_duration_seconds",
+		"Time to resolve a client put/get including forwarding, by operation.",
+		metrics.DefBuckets, "op")
+	peerRPCFailures = metrics.NewCounter("dht_peer_rpc_failures_total",
+		"Failed outbound calls to peers.")
+)
+
+// registerNodeMetrics exposes routing table and store sizes on /metrics.
+func registerNodeMetrics(store *Store, pl *PeerList, selfID string) {
+	metrics.NewGaugeFunc("dht_routing_table_peers", "Number of peers in the routing table.", func() float64 {
+		return float64(len(pl.Others(selfID)))
+	})
+	metrics.NewGaugeFunc("dht_store_keys", "Number of keys in the local store.", func() float64 {
+		keys, _ := store.Stats()
+		return float64(keys)
+	})
+	metrics.NewGaugeFunc("dht_store_bytes", "Total size of values in the local store.", func() float64 {
+		_, size := store.Stats()
+		return float64(size)
+	})
+}
+
+// requestHops returns the hop count of an incoming request (0 from a client).
+func requestHops(r *http.Request) int {
+	hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+	return hops
+}
+
+// observeLookup records a completed lookup. Only the node the client talked
+// to (hops == 0 on the incoming request) records it, so each lookup counts once.
+func observeLookup(r *http.Request, op string, hops int, start time.Time) {
+	if requestHops(r) != 0 {
+		return
+	}
+	lookupHops.Observe(float64(hops), op)
+	lookupDuration.Observe(time.Since(start).Seconds(), op)
+}
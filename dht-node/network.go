@@ -2,108 +2,284 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func pingBootstrap(bootstrapAddr string) (PeerInfo, error) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s/ping", bootstrapAddr))
+// joinLogger returns the logger used for join progress.
+func joinLogger() *slog.Logger {
+	return slog.Default().With("component", "join")
+}
+
+// getJSON fetches url from a peer and decodes the JSON response into v.
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := newPeerRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Do(req)
 	if err != nil {
-		return PeerInfo{}, err
+		return err
 	}
 	defer resp.Body.Close()
-	var bootstrap PeerInfo
-	if err := json.NewDecoder(resp.Body).Decode(&bootstrap); err != nil {
-		return PeerInfo{}, err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
 	}
-	return bootstrap, nil
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func fetchBootstrapPeers(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s/peers", bootstrapAddr))
-	if err != nil {
-		log.Printf("[JOIN] Failed to fetch peers from bootstrap: %v", err)
-		return
+// pingPeer pings the node at addr and returns its PeerInfo and the address
+// it saw the ping coming from.
+func pingPeer(ctx context.Context, addr string) (PingResponse, error) {
+	var resp PingResponse
+	if err := getJSON(ctx, fmt.Sprintf("http://%s/ping", addr), &resp); err != nil {
+		rpcErrors.Record(addr)
+		return PingResponse{}, err
 	}
-	defer resp.Body.Close()
+	return resp, nil
+}
+
+// addIfLive pings peer at its address and, if it answers with its node ID,
+// adds it to the routing table at that address. Rendezvous nodes are not
+// added.
+func addIfLive(ctx context.Context, peer PeerInfo, adv *Advertised, pl *PeerList, rpcTimeout time.Duration) bool {
+	pingCtx, cancel := withRPCTimeout(ctx, rpcTimeout)
+	pong, err := pingPeer(pingCtx, peer.Address)
+	cancel()
+	if err != nil || pong.NodeID != peer.NodeID || pong.Role == roleRendezvous {
+		return false
+	}
+	live := pong.PeerInfo
+	live.Address = peer.Address
+	pl.Add(live)
+	pl.MarkSeen(live.NodeID)
+	adv.Observe(live.NodeID, pong.ObservedAddr)
+	return true
+}
+
+func fetchBootstrapPeers(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList) {
 	var peers []PeerInfo
-	if err := json.NewDecoder(resp.Body).Decode(&peers); err == nil {
-		log.Printf("[JOIN] Fetched %d peers from bootstrap node", len(peers))
-		for _, p := range peers {
-			if p.NodeID != selfNodeID && p.Address != selfAddr {
-				pl.Add(p)
-			}
+	if err := getJSON(ctx, fmt.Sprintf("http://%s/peers", bootstrapAddr), &peers); err != nil {
+		joinLogger().Warn("failed to fetch peers from bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		rpcErrors.Record(bootstrapAddr)
+		return
+	}
+	for _, p := range peers {
+		if p.NodeID != selfNodeID && !adv.Has(p.Address) {
+			pl.Add(p)
 		}
-		log.Printf("[JOIN] Merged %d peers from bootstrap", len(peers))
-	} else {
-		log.Printf("[JOIN] Failed to decode peers from bootstrap: %v", err)
 	}
+	joinLogger().Info("merged peers from bootstrap", "bootstrap", bootstrapAddr, "peers", len(peers))
 }
 
-func announceSelf(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	selfInfo := PeerInfo{NodeID: selfNodeID, Address: selfAddr}
-	buf, _ := json.Marshal(selfInfo)
-	log.Println("[JOIN] Announcing self to bootstrap node via /register...")
+// announceSelf registers this node with bootstrap and records the address
+// bootstrap saw the registration coming from.
+func announceSelf(ctx context.Context, bootstrap PeerInfo, selfNodeID string, adv *Advertised, pl *PeerList) {
+	bootstrapAddr := bootstrap.Address
+	buf, _ := json.Marshal(adv.Info(selfNodeID))
 	logPeerList(pl, "joinNetwork BEFORE REGISTER")
-	regResp, err := client.Post(fmt.Sprintf("http://%s/register", bootstrapAddr), "application/json", bytes.NewReader(buf))
+	req, err := newPeerRequest(ctx, http.MethodPost, fmt.Sprintf("http://%s/register", bootstrapAddr), bytes.NewReader(buf))
+	if err != nil {
+		joinLogger().Warn("failed to announce self to bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	regResp, err := peerClient.Do(req)
 	if err == nil {
-		log.Printf("[JOIN] Announced self to bootstrap node at %s", bootstrapAddr)
-		log.Printf("[JOIN] /register response status: %s", regResp.Status)
 		body, _ := io.ReadAll(regResp.Body)
-		log.Printf("[JOIN] /register response body: %s", string(body))
 		regResp.Body.Close()
+		joinLogger().Info("announced self to bootstrap", "bootstrap", bootstrapAddr, "status", regResp.Status)
+		joinLogger().Debug("register response", "body", string(body))
+		var reg RegisterResponse
+		if json.Unmarshal(body, &reg) == nil && reg.ObservedAddr != "" {
+			adv.Observe(bootstrap.NodeID, reg.ObservedAddr)
+		}
 	} else {
-		log.Printf("[JOIN] Failed to announce self to bootstrap: %v", err)
+		joinLogger().Warn("failed to announce self to bootstrap", "bootstrap", bootstrapAddr, "err", err)
+		rpcErrors.Record(bootstrapAddr)
 	}
 	logPeerList(pl, "joinNetwork END")
 }
 
-func kademliaLookup(bootstrapAddr, selfNodeID, selfAddr string, pl *PeerList) {
-	client := &http.Client{Timeout: 3 * time.Second}
-	log.Printf("[JOIN] Performing Kademlia-style lookup for own node ID: %s", selfNodeID)
+func kademliaLookup(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList) {
+	joinLogger().Info("performing Kademlia-style lookup for own node ID", "target", selfNodeID)
 	lookupURL := fmt.Sprintf("http://%s/find_node?target=%s", bootstrapAddr, selfNodeID)
-	resp, err := client.Get(lookupURL)
-	if err == nil {
-		defer resp.Body.Close()
-		var foundPeers []PeerInfo
-		if err := json.NewDecoder(resp.Body).Decode(&foundPeers); err == nil {
-			log.Printf("[JOIN] /find_node returned %d peers", len(foundPeers))
-			for _, p := range foundPeers {
-				if p.NodeID != selfNodeID && p.Address != selfAddr {
-					pl.Add(p)
-				}
-			}
-			logPeerList(pl, "joinNetwork AFTER FIND_NODE")
-		} else {
-			log.Printf("[JOIN] Failed to decode /find_node response: %v", err)
+	var foundPeers []PeerInfo
+	if err := getJSON(ctx, lookupURL, &foundPeers); err != nil {
+		joinLogger().Warn("failed to call find_node", "bootstrap", bootstrapAddr, "err", err)
+		rpcErrors.Record(bootstrapAddr)
+		return
+	}
+	joinLogger().Info("find_node returned peers", "peers", len(foundPeers))
+	for _, p := range foundPeers {
+		if p.NodeID != selfNodeID && !adv.Has(p.Address) {
+			pl.Add(p)
 		}
-	} else {
-		log.Printf("[JOIN] Failed to call /find_node: %v", err)
 	}
+	logPeerList(pl, "joinNetwork AFTER FIND_NODE")
 }
 
-func joinNetwork(bootstrapAddr, selfAddr, selfNodeID string, pl *PeerList) {
-	log.Printf("[JOIN] Attempting to join network via bootstrap node at %s", bootstrapAddr)
+// joinNetwork runs the join steps against bootstrapAddr. Each step is a
+// separate call to the bootstrap node bounded by rpcTimeout; cancelling ctx
+// aborts the join. It fails only if the bootstrap node cannot be reached.
+func joinNetwork(ctx context.Context, bootstrapAddr, selfNodeID string, adv *Advertised, pl *PeerList, rpcTimeout time.Duration) error {
+	joinLogger().Info("attempting to join network", "bootstrap", bootstrapAddr)
 	logPeerList(pl, "joinNetwork START")
 
-	bootstrap, err := pingBootstrap(bootstrapAddr)
+	step := func(fn func(ctx context.Context)) {
+		stepCtx, cancel := withRPCTimeout(ctx, rpcTimeout)
+		defer cancel()
+		fn(stepCtx)
+	}
+
+	var pong PingResponse
+	var err error
+	step(func(ctx context.Context) { pong, err = pingPeer(ctx, bootstrapAddr) })
 	if err != nil {
-		log.Printf("[JOIN] Failed to ping bootstrap node: %v", err)
-		return
+		joinLogger().Error("failed to ping bootstrap node", "bootstrap", bootstrapAddr, "err", err)
+		return err
+	}
+	bootstrap := pong.PeerInfo
+	adv.Observe(bootstrap.NodeID, pong.ObservedAddr)
+	// A rendezvous node only helps with joining and is not a peer
+	if pong.Role != roleRendezvous {
+		pl.Add(bootstrap)
+		pl.MarkSeen(bootstrap.NodeID)
+		joinLogger().Info("added bootstrap peer", "peer_id", bootstrap.NodeID, "peer_addr", bootstrap.Address)
+	}
+
+	step(func(ctx context.Context) { fetchBootstrapPeers(ctx, bootstrapAddr, selfNodeID, adv, pl) })
+	// Register through the address that answered, which may differ from the
+	// one the bootstrap node advertises
+	dialed := PeerInfo{NodeID: bootstrap.NodeID, Address: bootstrapAddr}
+	step(func(ctx context.Context) { announceSelf(ctx, dialed, selfNodeID, adv, pl) })
+	step(func(ctx context.Context) { kademliaLookup(ctx, bootstrapAddr, selfNodeID, adv, pl) })
+	if pong.Role == roleRendezvous {
+		// Nobody else learns about this node from a rendezvous node, so
+		// introduce it to the peers found through it
+		for _, p := range pl.Others(selfNodeID) {
+			step(func(ctx context.Context) { announceSelf(ctx, p, selfNodeID, adv, pl) })
+		}
 	}
-	pl.Add(bootstrap)
-	log.Printf("[JOIN] Added bootstrap peer: %+v", bootstrap)
 
-	fetchBootstrapPeers(bootstrapAddr, selfNodeID, selfAddr, pl)
-	announceSelf(bootstrapAddr, selfNodeID, selfAddr, pl)
-	kademliaLookup(bootstrapAddr, selfNodeID, selfAddr, pl)
+	joinLogger().Info("discovery and connection process complete")
+	return nil
+}
+
+type peerKeysResult struct {
+	peer PeerInfo
+	page KeysResponse
+	err  error
+}
+
+// fetchClusterKeys requests one page of local keys from each peer in parallel,
+// giving each peer at most rpcTimeout to answer.
+func fetchClusterKeys(ctx context.Context, peers []PeerInfo, prefix, cursor string, limit int, withMeta bool, rpcTimeout time.Duration) []peerKeysResult {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	q.Set("cursor", cursor)
+	q.Set("limit", strconv.Itoa(limit))
+	if withMeta {
+		q.Set("meta", "true")
+	}
+	results := make([]peerKeysResult, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p PeerInfo) {
+			defer wg.Done()
+			defer jobs.Start("cluster_keys")()
+			results[i].peer = p
+			peerCtx, cancel := withRPCTimeout(ctx, rpcTimeout)
+			defer cancel()
+			results[i].err = getJSON(peerCtx, fmt.Sprintf("http://%s/keys?%s", p.Address, q.Encode()), &results[i].page)
+		}(i, p)
+	}
+	wg.Wait()
+	return results
+}
+
+// postNDJSON posts body as JSON to a peer with the given forwarding state and
+// calls fn for every line of the NDJSON response as it arrives.
+func postNDJSON(ctx context.Context, peer PeerInfo, path string, rt route, body any, fn func(line json.RawMessage) error) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := peerContext(ctx)
+	defer cancel()
+	req, err := newPeerRequest(ctx, http.MethodPost, fmt.Sprintf("http://%s%s", peer.Address, path), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rt.setHeaders(req)
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
 
-	log.Printf("[JOIN] Discovery and connection process complete.")
+// forwardRequest sends a JSON put/get to a peer with the given forwarding state and
+// copies the peer's response to w. It returns the hop count the peer reported.
+// If tr is non-nil the request is traced: a successful response is decoded
+// into out and written back with this node's hop in front of the peer's trace.
+func forwardRequest(ctx context.Context, w http.ResponseWriter, method, url string, body io.Reader, rt route, tr *tracer, out traceable) (int, error) {
+	ctx, cancel := peerContext(ctx)
+	defer cancel()
+	req, err := newPeerRequest(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rt.setHeaders(req)
+	if tr != nil {
+		req.Header.Set(traceHeader, "1")
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respHops, err := strconv.Atoi(resp.Header.Get(hopsHeader))
+	if err != nil {
+		respHops = rt.hops
+	}
+	w.Header().Set(hopsHeader, strconv.Itoa(respHops))
+	w.Header().Set("Content-Type", "application/json")
+	if tr != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return respHops, err
+		}
+		out.prependHop(tr.hop(decisionForwarded, req.URL.Host))
+		json.NewEncoder(w).Encode(out)
+		return respHops, nil
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return respHops, nil
 }
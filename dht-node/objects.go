@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dht-logging"
+	"dht-version"
+)
+
+// maxObjectSize bounds the body of an object write.
+const maxObjectSize = 64 << 20
+
+// objectCondition turns the If-Match / If-None-Match request headers of a
+// write into a Condition. ETags are the hex SHA-1 of the content.
+func objectCondition(r *http.Request) version.Condition {
+	var cond version.Condition
+	if m := r.Header.Values("If-Match"); len(m) > 0 {
+		tags, any := parseETags(strings.Join(m, ","))
+		if any {
+			cond.IfPresent = true
+		} else {
+			cond.IfHashIn = tags
+		}
+	}
+	if _, any := parseETags(strings.Join(r.Header.Values("If-None-Match"), ",")); any {
+		cond.IfAbsent = true
+	}
+	return cond
+}
+
+// parseETags parses an If-Match or If-None-Match header: "*" or a
+// comma-separated list of entity tags. It returns the opaque values of the
+// strong tags and whether the header is "*". Weak tags (W/"...") are left
+// out, as they never match under the strong comparison If-Match uses.
+func parseETags(h string) (strong []string, any bool) {
+	strong = []string{}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "*":
+			any = true
+		case len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"':
+			strong = append(strong, t[1:len(t)-1])
+		}
+	}
+	return strong, any
+}
+
+// etag returns the strong ETag of a value with the given hash: the quoted
+// hash. For content-addressed keys this is the key itself.
+func etag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// readObject reads the body of an object write, up to maxObjectSize, hashing
+// it while it is copied. On error it writes 413 or 400 and reports false.
+func readObject(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	var buf bytes.Buffer
+	h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, h), http.MaxBytesReader(w, r.Body, maxObjectSize)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return nil, "", false
+	}
+	return buf.Bytes(), hex.EncodeToString(h.Sum(nil)), true
+}
+
+// objectGetHandler handles GET and HEAD /v1/objects/{key}, serving the raw
+// value locally or forwarding the request to the responsible peer.
+func objectGetHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		siblings, ok := store.Get(key)
+		if !ok {
+			rt := incomingRoute(r)
+			peer, isSelf, err := nextHop(router, rt, key, maxHops)
+			if err != nil {
+				writeRoutingError(w, r, key, selfID, rt, err)
+				return
+			}
+			if isSelf {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			logging.RequestLogger(r.Context()).Info("forwarding object request", "method", r.Method, "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
+			forwardObject(w, r, peer, r.URL.Path, nil, rt.forward(selfID))
+			return
+		}
+		if len(siblings) > 1 {
+			// Conflicting values cannot be served as one object
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultipleChoices)
+			json.NewEncoder(w).Encode(newGetResponse(key, siblings))
+			return
+		}
+		v := siblings[0]
+		ct := v.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("ETag", etag(version.HashValue(v.Value)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(v.Value))
+	}
+}
+
+// objectPutHandler handles PUT /v1/objects/{key}. The body is stored with its
+// Content-Type, or streamed on to the responsible peer.
+func objectPutHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		r.Body = http.MaxBytesReader(w, r.Body, maxObjectSize)
+		rt := incomingRoute(r)
+		peer, isSelf, err := nextHop(router, rt, key, maxHops)
+		if err != nil {
+			writeRoutingError(w, r, key, selfID, rt, err)
+			return
+		}
+		if !isSelf {
+			logging.RequestLogger(r.Context()).Info("forwarding object request", "method", "PUT", "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
+			forwardObject(w, r, peer, r.URL.Path, r.Body, rt.forward(selfID))
+			return
+		}
+		body, hash, ok := readObject(w, r)
+		if !ok {
+			return
+		}
+		storeObject(w, r, store, key, body, hash, http.StatusNoContent)
+	}
+}
+
+// objectPostHandler handles POST /v1/objects, storing the body under its
+// content hash and returning the new location.
+func objectPostHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, key, ok := readObject(w, r)
+		if !ok {
+			return
+		}
+		rt := incomingRoute(r)
+		peer, isSelf, err := nextHop(router, rt, key, maxHops)
+		if err != nil {
+			writeRoutingError(w, r, key, selfID, rt, err)
+			return
+		}
+		if !isSelf {
+			// The peer hashes the body to the same key and answers with the
+			// location once it has stored it
+			logging.RequestLogger(r.Context()).Info("forwarding object request", "method", "POST", "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
+			forwardObject(w, r, peer, r.URL.Path, bytes.NewReader(body), rt.forward(selfID))
+			return
+		}
+		storeObject(w, r, store, key, body, key, http.StatusCreated)
+	}
+}
+
+// storeObject stores body, whose SHA-1 is hash, under key in the local store
+// and writes the response: status once stored, with the object's Location if
+// that is 201 Created.
+func storeObject(w http.ResponseWriter, r *http.Request, store *Store, key string, body []byte, hash string, status int) {
+	_, err := store.PutObject(key, body, r.Header.Get("Content-Type"), objectCondition(r))
+	if errors.Is(err, version.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(hash))
+	if status == http.StatusCreated {
+		w.Header().Set("Location", fmt.Sprintf("/v1/objects/%s", key))
+	}
+	w.WriteHeader(status)
+}
+
+// objectDeleteHandler handles DELETE /v1/objects/{key}
+func objectDeleteHandler(store *Store, router Router, selfID string, maxHops int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		rt := incomingRoute(r)
+		peer, isSelf, err := nextHop(router, rt, key, maxHops)
+		if err != nil {
+			writeRoutingError(w, r, key, selfID, rt, err)
+			return
+		}
+		if !isSelf {
+			logging.RequestLogger(r.Context()).Info("forwarding object request", "method", "DELETE", "key", key, "peer_id", peer.NodeID, "peer_addr", peer.Address)
+			forwardObject(w, r, peer, r.URL.Path, nil, rt.forward(selfID))
+			return
+		}
+		existed, err := store.Delete(key, objectCondition(r))
+		if errors.Is(err, version.ErrPreconditionFailed) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !existed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// objectHeaders are the request headers passed on when forwarding an object request.
+var objectHeaders = []string{"Content-Type", "Range", "If-Range", "If-Match", "If-None-Match"}
+
+// forwardObject proxies an object request to peer with the given forwarding
+// state, streaming body and the response without buffering them.
+func forwardObject(w http.ResponseWriter, r *http.Request, peer PeerInfo, path string, body io.Reader, rt route) {
+	ctx, cancel := peerContext(r.Context())
+	defer cancel()
+	req, err := newPeerRequest(ctx, r.Method, fmt.Sprintf("http://%s%s", peer.Address, path), body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if body == r.Body {
+		req.ContentLength = r.ContentLength
+	}
+	rt.setHeaders(req)
+	for _, h := range objectHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		logging.RequestLogger(r.Context()).Warn("failed to forward object request", "peer_addr", peer.Address, "err", err)
+		rpcErrors.Record(peer.Address)
+		w.WriteHeader(forwardErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+	forwardedRequests.Inc("object")
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestObjectPostLocation checks that an upload only reports a location once
+// the object is stored, also when it is forwarded to the responsible node.
+func TestObjectPostLocation(t *testing.T) {
+	nodes := newTestCluster(t, routingKademlia, []string{"1000000000000000", "5000000000000000", "9000000000000000"})
+	body := "object body"
+	h := sha1.Sum([]byte(body))
+	key := hex.EncodeToString(h[:])
+	owner, other := responsible(t, nodes, key)
+	tests := []struct {
+		name     string
+		ifMatch  string
+		status   int
+		location string
+	}{
+		{"refused", `"0000"`, http.StatusPreconditionFailed, ""},
+		{"stored", "", http.StatusCreated, "/v1/objects/" + key},
+	}
+	for _, n := range []*testNode{other, owner} {
+		for _, tt := range tests {
+			req, _ := http.NewRequest(http.MethodPost, n.srv.URL+"/v1/objects", strings.NewReader(body))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Location"); resp.StatusCode != tt.status || got != tt.location {
+				t.Errorf("%s upload through %s: %s with location %q, want %d with %q", tt.name, n.id, resp.Status, got, tt.status, tt.location)
+			}
+		}
+	}
+	if _, ok := owner.store.Get(key); !ok {
+		t.Errorf("object not stored on the responsible node %s", owner.id)
+	}
+}
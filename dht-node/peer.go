@@ -1,39 +1,82 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
-	"log"
+	"log/slog"
 	"sort"
 	"sync"
+	"time"
+
+	"dht-multiaddr"
 )
 
 type PeerInfo struct {
-	NodeID  string `json:"node_id"`
-	Address string `json:"address"`
+	NodeID    string           `json:"node_id"`
+	Address   string           `json:"address"`             // primary address (host:port), what older nodes read
+	Addresses []multiaddr.Addr `json:"addresses,omitempty"` // every advertised address, in the peer's order of preference
 }
 
 type PeerList struct {
-	mu    sync.RWMutex
-	peers map[string]PeerInfo
+	mu       sync.RWMutex
+	peers    map[string]PeerInfo
+	lastSeen map[string]time.Time // node ID -> last time the peer answered or contacted us
 }
 
 func NewPeerList() *PeerList {
-	return &PeerList{peers: make(map[string]PeerInfo)}
+	return &PeerList{peers: make(map[string]PeerInfo), lastSeen: make(map[string]time.Time)}
 }
 
 func (pl *PeerList) Add(peer PeerInfo) {
+	if peer.Address == "" && len(peer.Addresses) > 0 {
+		peer.Address = peer.Addresses[0].HostPort()
+	}
+	peerClient.Learn(peer)
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if peer.NodeID != "" && peer.Address != "" {
 		if _, exists := pl.peers[peer.NodeID]; !exists {
-			log.Printf("Discovered new peer: %s at %s", peer.NodeID, peer.Address)
+			slog.Info("discovered new peer", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 		} else {
-			log.Printf("Peer already known: %s at %s", peer.NodeID, peer.Address)
+			slog.Debug("peer already known", "peer_id", peer.NodeID, "peer_addr", peer.Address)
 		}
 		pl.peers[peer.NodeID] = peer
 	}
 }
 
+// Get returns the peer with nodeID, if known.
+func (pl *PeerList) Get(nodeID string) (PeerInfo, bool) {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	p, ok := pl.peers[nodeID]
+	return p, ok
+}
+
+// Remove drops the peer with nodeID from the routing table.
+func (pl *PeerList) Remove(nodeID string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	delete(pl.peers, nodeID)
+	delete(pl.lastSeen, nodeID)
+}
+
+// MarkSeen records that the peer with nodeID was just heard from directly.
+func (pl *PeerList) MarkSeen(nodeID string) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if _, ok := pl.peers[nodeID]; ok {
+		pl.lastSeen[nodeID] = time.Now()
+	}
+}
+
+// LastSeen returns when the peer with nodeID was last heard from directly,
+// or the zero time if never.
+func (pl *PeerList) LastSeen(nodeID string) time.Time {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.lastSeen[nodeID]
+}
+
 func (pl *PeerList) All() []PeerInfo {
 	pl.mu.RLock()
 	defer pl.mu.RUnlock()
@@ -44,11 +87,30 @@ func (pl *PeerList) All() []PeerInfo {
 	return result
 }
 
-func logPeerList(pl *PeerList, context string) {
-	log.Printf("[%s] Current routing table:", context)
-	for _, p := range pl.All() {
-		log.Printf("  Peer: %s at %s", p.NodeID, p.Address)
+// Others returns all known peers except the node with selfID.
+func (pl *PeerList) Others(selfID string) []PeerInfo {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	result := make([]PeerInfo, 0, len(pl.peers))
+	for _, p := range pl.peers {
+		if p.NodeID != selfID {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// logPeerList logs the current routing table at debug level.
+func logPeerList(pl *PeerList, label string) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	peers := pl.All()
+	entries := make([]string, 0, len(peers))
+	for _, p := range peers {
+		entries = append(entries, p.NodeID+"@"+p.Address)
 	}
+	slog.Debug("current routing table", "context", label, "peers", entries)
 }
 
 func xorDistance(a, b string) uint64 {
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"dht-multiaddr"
+)
+
+const (
+	defaultPeerMaxInFlight  = 32
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+)
+
+// ErrCircuitOpen is returned for calls to a peer whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit open: peer is failing")
+
+// peerClient is used for every outbound call to a peer. main replaces it
+// once the flags are parsed.
+var peerClient = newPeerClient(defaultPeerMaxInFlight, defaultBreakerThreshold, defaultBreakerCooldown)
+
+// PeerClient is a shared HTTP client for calls to peers. It keeps a pool of
+// keep-alive connections per peer, limits the number of requests in flight
+// to each peer, and has a circuit breaker per peer: after threshold
+// consecutive failures the peer is skipped by routing and calls to it fail
+// fast, until a background /ping probe succeeds.
+//
+// Peers are identified by their primary address. A peer that advertises
+// several addresses is dialed at the one that worked last, falling back to
+// the others when a connection cannot be made.
+type PeerClient struct {
+	client      *http.Client
+	maxInFlight int
+	threshold   int
+	cooldown    time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*peerState // primary peer address -> state
+}
+
+type peerState struct {
+	slots    chan struct{} // one token per request in flight
+	failures int           // consecutive failures
+	open     bool
+	openedAt time.Time
+	addrs    []string // advertised addresses, in the peer's order
+	dialed   string   // address the last successful call went to
+}
+
+func newPeerClient(maxInFlight, threshold int, cooldown time.Duration) *PeerClient {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 2 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        0, // no global limit, MaxIdleConnsPerHost applies
+		MaxIdleConnsPerHost: maxInFlight,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &PeerClient{
+		client:      &http.Client{Transport: transport},
+		maxInFlight: maxInFlight,
+		threshold:   threshold,
+		cooldown:    cooldown,
+		peers:       make(map[string]*peerState),
+	}
+}
+
+func (pc *PeerClient) state(addr string) *peerState {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	st, ok := pc.peers[addr]
+	if !ok {
+		st = &peerState{slots: make(chan struct{}, pc.maxInFlight)}
+		pc.peers[addr] = st
+	}
+	return st
+}
+
+// Learn records the addresses a peer advertises.
+func (pc *PeerClient) Learn(p PeerInfo) {
+	if p.Address == "" || len(p.Addresses) == 0 {
+		return
+	}
+	st := pc.state(p.Address)
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	st.addrs = multiaddr.HostPorts(p.Addresses)
+}
+
+// Prune forgets the peers whose primary address is not in keep, such as
+// peers that left the routing table or addresses that were only tried once.
+// Peers with requests in flight are kept until the next call.
+func (pc *PeerClient) Prune(keep []string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for addr, st := range pc.peers {
+		if len(st.slots) == 0 && !slices.Contains(keep, addr) {
+			delete(pc.peers, addr)
+		}
+	}
+}
+
+// prunePeerClient drops the peer client state of peers no longer in the
+// routing table every interval, until ctx is done.
+func prunePeerClient(ctx context.Context, pl *PeerList, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var keep []string
+			for _, p := range pl.All() {
+				keep = append(keep, p.Address)
+			}
+			peerClient.Prune(keep)
+		}
+	}
+}
+
+// Dialed returns the address the last successful call to the peer with
+// primary address addr went to, or "" if there was none.
+func (pc *PeerClient) Dialed(addr string) string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if st, ok := pc.peers[addr]; ok {
+		return st.dialed
+	}
+	return ""
+}
+
+// dialOrder returns the addresses to try for a peer: the one that worked
+// last, then the advertised ones in the peer's order, then the primary
+// address. Loopback addresses of a peer whose primary address is not a
+// loopback address go last, since they only reach it from the same host.
+func (pc *PeerClient) dialOrder(addr string, st *peerState) []string {
+	pc.mu.Lock()
+	candidates := append([]string{st.dialed}, st.addrs...)
+	pc.mu.Unlock()
+	candidates = append(candidates, addr)
+
+	remote := !isLoopbackHostPort(addr)
+	var order, last []string
+	for _, a := range candidates {
+		if a == "" || slices.Contains(order, a) || slices.Contains(last, a) {
+			continue
+		}
+		if remote && a != candidates[0] && isLoopbackHostPort(a) {
+			last = append(last, a)
+		} else {
+			order = append(order, a)
+		}
+	}
+	return append(order, last...)
+}
+
+func isLoopbackHostPort(hostPort string) bool {
+	host, _, _ := net.SplitHostPort(hostPort)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dial sends req to the first of the peer's addresses that accepts a
+// connection. Another address is only tried after a dial error, and only if
+// the request body can be sent again.
+func (pc *PeerClient) dial(req *http.Request, addr string, st *peerState) (*http.Response, error) {
+	var err error
+	for i, target := range pc.dialOrder(addr, st) {
+		attempt := req
+		if target != addr {
+			attempt = req.Clone(req.Context())
+			attempt.URL.Host, attempt.Host = target, target
+		}
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				break
+			}
+			if attempt == req {
+				attempt = req.Clone(req.Context())
+			}
+			attempt.Body = body
+		}
+		var resp *http.Response
+		if resp, err = pc.client.Do(attempt); err == nil {
+			pc.mu.Lock()
+			if st.dialed != target {
+				slog.Debug("dialing peer at new address", "peer_addr", addr, "dialed", target)
+				st.dialed = target
+			}
+			pc.mu.Unlock()
+			return resp, nil
+		}
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || opErr.Op != "dial" {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Do sends req to the peer whose primary address is req.URL.Host. It waits
+// for a free in-flight slot (or for the request context to end) and fails
+// fast with ErrCircuitOpen if the peer's breaker is open. The slot is
+// released when the response body is closed.
+func (pc *PeerClient) Do(req *http.Request) (*http.Response, error) {
+	if addr := req.URL.Host; !pc.Available(addr) {
+		return nil, fmt.Errorf("%s: %w", addr, ErrCircuitOpen)
+	}
+	return pc.send(req)
+}
+
+// Check sends req like Do, but also to a peer whose breaker is open. It is
+// meant for liveness probes: an answer closes the breaker.
+func (pc *PeerClient) Check(req *http.Request) (*http.Response, error) {
+	return pc.send(req)
+}
+
+func (pc *PeerClient) send(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Host
+	st := pc.state(addr)
+	select {
+	case st.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := pc.dial(req, addr, st)
+	if err != nil {
+		<-st.slots
+		if peerFault(req.Context()) {
+			pc.failure(addr, st)
+		}
+		return nil, err
+	}
+	pc.success(addr, st)
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-st.slots }}
+	return resp, nil
+}
+
+// Available reports whether routing may use the peer at addr, i.e. its
+// circuit breaker is not open.
+func (pc *PeerClient) Available(addr string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	st, ok := pc.peers[addr]
+	return !ok || !st.open
+}
+
+// Circuits returns the open-since time of every peer whose breaker is open.
+func (pc *PeerClient) Circuits() map[string]time.Time {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	result := make(map[string]time.Time)
+	for addr, st := range pc.peers {
+		if st.open {
+			result[addr] = st.openedAt
+		}
+	}
+	return result
+}
+
+func (pc *PeerClient) success(addr string, st *peerState) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if st.open {
+		slog.Info("circuit closed, peer is reachable again", "peer_addr", addr)
+	}
+	st.failures = 0
+	st.open = false
+}
+
+func (pc *PeerClient) failure(addr string, st *peerState) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	st.failures++
+	if st.open || st.failures < pc.threshold {
+		return
+	}
+	st.open = true
+	st.openedAt = time.Now()
+	slog.Warn("circuit opened, routing around peer", "peer_addr", addr, "failures", st.failures)
+	time.AfterFunc(pc.cooldown, func() { pc.probe(addr, st) })
+}
+
+// probe pings a peer with an open breaker, closing the breaker if it answers
+// and trying again after another cooldown if not. It stops once the peer is
+// pruned.
+func (pc *PeerClient) probe(addr string, st *peerState) {
+	// Closed in the meantime by a successful liveness check, or pruned
+	pc.mu.Lock()
+	stale := pc.peers[addr] != st || !st.open
+	pc.mu.Unlock()
+	if stale {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pc.cooldown)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/ping", addr), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = pc.dial(req, addr, st); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				pc.success(addr, st)
+				return
+			}
+		}
+	}
+	slog.Debug("probe failed, circuit stays open", "peer_addr", addr, "err", err)
+	time.AfterFunc(pc.cooldown, func() { pc.probe(addr, st) })
+}
+
+// releaseBody releases a peer's in-flight slot when the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"dht-pex"
+)
+
+// pexTable is the routing table as the peer exchange sees it.
+type pexTable struct {
+	selfID     string
+	adv        *Advertised
+	pl         *PeerList
+	rpcTimeout time.Duration
+}
+
+func (t pexTable) Self() pex.Peer {
+	return pex.Peer(t.adv.Info(t.selfID))
+}
+
+func (t pexTable) Members() []pex.Peer {
+	peers := t.pl.Others(t.selfID)
+	result := make([]pex.Peer, len(peers))
+	for i, p := range peers {
+		result[i] = pex.Peer(p)
+	}
+	return result
+}
+
+func (t pexTable) Known(nodeID string) bool {
+	_, ok := t.pl.Get(nodeID)
+	return ok
+}
+
+func (t pexTable) Seen(nodeID string) {
+	t.pl.MarkSeen(nodeID)
+}
+
+func (t pexTable) IsSelf(hostPort string) bool {
+	return t.adv.Has(hostPort)
+}
+
+func (t pexTable) AddIfLive(ctx context.Context, p pex.Peer) bool {
+	return addIfLive(ctx, PeerInfo(p), t.adv, t.pl, t.rpcTimeout)
+}
+
+// pexClient sends exchanges through the peer client, so that peers whose
+// breaker is open are left out.
+type pexClient struct{}
+
+func (pexClient) Do(req *http.Request) (*http.Response, error) {
+	setPeerDeadline(req)
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		rpcErrors.Record(req.URL.Host)
+	}
+	return resp, err
+}
+
+func (pexClient) Available(hostPort string) bool {
+	return peerClient.Available(hostPort)
+}
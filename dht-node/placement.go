@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Placement strategies, chosen with --placement.
+const (
+	placementXOR        = "xor"
+	placementConsistent = "consistent"
+	placementRendezvous = "rendezvous"
+
+	defaultPlacementVnodes = 64
+	maxPlacementVnodes     = 4096
+)
+
+var placementNames = []string{placementXOR, placementConsistent, placementRendezvous}
+
+// Placement decides which nodes are responsible for a key. Nodes are ranked
+// by their distance to the key: the closest node is responsible, the next
+// ones take over when it is unreachable.
+type Placement interface {
+	// Name returns the strategy name, as given to --placement.
+	Name() string
+	// Distance returns how far key is from the node with id. Lower is closer.
+	Distance(id, key string) uint64
+}
+
+func newPlacement(name string, vnodes int) (Placement, error) {
+	switch name {
+	case placementXOR:
+		return xorPlacement{}, nil
+	case placementConsistent:
+		return &consistentPlacement{vnodes: vnodes, points: make(map[string][]uint64)}, nil
+	case placementRendezvous:
+		return rendezvousPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement %q", name)
+}
+
+// hash64 returns the first 64 bits of the SHA-1 of s.
+func hash64(s string) uint64 {
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// comparePlacement orders the nodes a and b by their distance to key. Ties,
+// which XOR gives for keys that are not hex, are broken by node ID so that
+// every node ranks the same way.
+func comparePlacement(p Placement, key, a, b string) int {
+	return cmp.Or(cmp.Compare(p.Distance(a, key), p.Distance(b, key)), cmp.Compare(a, b))
+}
+
+// rankPeers sorts peers from closest to farthest from key.
+func rankPeers(p Placement, key string, peers []PeerInfo) []PeerInfo {
+	slices.SortFunc(peers, func(a, b PeerInfo) int { return comparePlacement(p, key, a.NodeID, b.NodeID) })
+	return peers
+}
+
+// xorPlacement is Kademlia's metric: the XOR of the first 64 bits of the node
+// ID and the key, both read as hex.
+type xorPlacement struct{}
+
+func (xorPlacement) Name() string                   { return placementXOR }
+func (xorPlacement) Distance(id, key string) uint64 { return xorDistance(id, key) }
+
+// consistentPlacement puts every node at vnodes points of a 64-bit ring and
+// each key at the hash of the key. A key belongs to the node with the first
+// point clockwise from it, so the distance is how far clockwise that node's
+// nearest point lies.
+type consistentPlacement struct {
+	vnodes int
+
+	mu     sync.Mutex
+	points map[string][]uint64 // node ID -> sorted ring positions
+}
+
+func (c *consistentPlacement) Name() string { return placementConsistent }
+
+func (c *consistentPlacement) Distance(id, key string) uint64 {
+	points := c.pointsOf(id)
+	h := hash64(key)
+	i, _ := slices.BinarySearch(points, h)
+	if i == len(points) {
+		i = 0 // wrap around the ring
+	}
+	return points[i] - h
+}
+
+// pointsOf returns the ring positions of a node, computing them once.
+func (c *consistentPlacement) pointsOf(id string) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if points, ok := c.points[id]; ok {
+		return points
+	}
+	points := make([]uint64, c.vnodes)
+	for i := range points {
+		points[i] = hash64(id + "#" + strconv.Itoa(i))
+	}
+	slices.Sort(points)
+	c.points[id] = points
+	return points
+}
+
+// retain drops the ring positions of the nodes not in ids, so that the
+// cache only holds the current members of the routing table.
+func (c *consistentPlacement) retain(ids []string) {
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	maps.DeleteFunc(c.points, func(id string, _ []uint64) bool { return !keep[id] })
+}
+
+// rendezvousPlacement (highest random weight) gives each node a pseudo-random
+// score for each key, the hash of both. The node with the highest score is
+// responsible. Removing a node only moves its own keys, and each of them to
+// whichever node scores next, so the load stays even without virtual nodes.
+type rendezvousPlacement struct{}
+
+func (rendezvousPlacement) Name() string { return placementRendezvous }
+
+func (rendezvousPlacement) Distance(id, key string) uint64 {
+	return ^hash64(id + "/" + key)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestConsistentPlacementRetain(t *testing.T) {
+	p, err := newPlacement(placementConsistent, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.(*consistentPlacement)
+	ids := []string{"1000000000000000", "5000000000000000", "9000000000000000"}
+	want := make(map[string]uint64)
+	for _, id := range ids {
+		want[id] = c.Distance(id, "key")
+	}
+
+	c.retain(ids[1:])
+	if got := slices.Sorted(maps.Keys(c.points)); !slices.Equal(got, ids[1:]) {
+		t.Errorf("cached nodes %v, want %v", got, ids[1:])
+	}
+	// A node dropped from the cache is placed the same when it comes back
+	for _, id := range ids {
+		if got := c.Distance(id, "key"); got != want[id] {
+			t.Errorf("Distance(%s, key) = %x, want %x", id, got, want[id])
+		}
+	}
+}
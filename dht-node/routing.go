@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dht-logging"
+)
+
+// visitedHeader lists the node IDs a forwarded request has passed through,
+// comma separated. Together with hopsHeader it stops requests from bouncing
+// between nodes whose routing tables disagree.
+const visitedHeader = "X-DHT-Visited"
+
+const defaultMaxHops = 8
+
+// placementPruneInterval is how often Kademlia drops the cached ring
+// positions of nodes that left the routing table.
+const placementPruneInterval = time.Minute
+
+// Routing overlays, chosen with --routing.
+const (
+	routingKademlia = "kademlia"
+	routingChord    = "chord"
+)
+
+// Router is a routing overlay: it decides which node is responsible for a
+// key, and which peer a request for the key goes to next.
+type Router interface {
+	// Name returns the overlay name, as given to --routing.
+	Name() string
+	// NextHop returns the peer to forward a request for key to, or reports
+	// that this node is responsible for the key.
+	NextHop(key string) (PeerInfo, bool)
+	// Distance returns how far key is from the node with id, in the
+	// overlay's metric.
+	Distance(id, key string) uint64
+	// Run maintains the overlay until ctx is done.
+	Run(ctx context.Context)
+}
+
+// Kademlia routes every request straight to the known peer closest to the
+// key under the placement strategy, XOR distance by default. The routing
+// table is maintained by joining, peer exchange and failure detection; all
+// Run does is drop what consistent placement cached for nodes that left it.
+type Kademlia struct {
+	selfID    string
+	pl        *PeerList
+	placement Placement
+}
+
+func (k *Kademlia) Name() string { return routingKademlia }
+
+// NextHop returns the peer closest to key, skipping peers whose circuit
+// breaker is open.
+func (k *Kademlia) NextHop(key string) (PeerInfo, bool) {
+	for _, p := range rankPeers(k.placement, key, k.pl.All()) {
+		if p.NodeID == k.selfID {
+			break
+		}
+		if peerClient.Available(p.Address) {
+			return p, false
+		}
+	}
+	return PeerInfo{}, true
+}
+
+func (k *Kademlia) Distance(id, key string) uint64 { return k.placement.Distance(id, key) }
+
+func (k *Kademlia) Run(ctx context.Context) {
+	c, ok := k.placement.(*consistentPlacement)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(placementPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var ids []string
+		for _, p := range k.pl.All() {
+			ids = append(ids, p.NodeID)
+		}
+		c.retain(ids)
+	}
+}
+
+var (
+	ErrRoutingLoop = errors.New("routing loop")
+	ErrHopLimit    = errors.New("hop limit reached")
+)
+
+// route is the forwarding state carried by a request.
+type route struct {
+	hops    int
+	visited []string
+}
+
+// incomingRoute reads the forwarding state of a request (zero from a client).
+func incomingRoute(r *http.Request) route {
+	rt := route{hops: requestHops(r)}
+	if v := r.Header.Get(visitedHeader); v != "" {
+		rt.visited = strings.Split(v, ",")
+	}
+	return rt
+}
+
+// forward returns the state to send to the next hop.
+func (rt route) forward(selfID string) route {
+	return route{hops: rt.hops + 1, visited: append(slices.Clip(rt.visited), selfID)}
+}
+
+// setHeaders writes the state to an outgoing request.
+func (rt route) setHeaders(req *http.Request) {
+	req.Header.Set(hopsHeader, strconv.Itoa(rt.hops))
+	if len(rt.visited) > 0 {
+		req.Header.Set(visitedHeader, strings.Join(rt.visited, ","))
+	}
+}
+
+// nextHop returns the router's next hop for key, and whether this node is
+// responsible for it. It refuses to forward to a peer the request has already
+// visited, or beyond maxHops, returning ErrRoutingLoop or ErrHopLimit.
+func nextHop(router Router, rt route, key string, maxHops int) (PeerInfo, bool, error) {
+	peer, isSelf := router.NextHop(key)
+	if isSelf {
+		return peer, true, nil
+	}
+	if slices.Contains(rt.visited, peer.NodeID) {
+		return peer, false, fmt.Errorf("%w: next hop %s was already visited", ErrRoutingLoop, peer.NodeID)
+	}
+	if rt.hops >= maxHops {
+		return peer, false, fmt.Errorf("%w: request took %d hops", ErrHopLimit, rt.hops)
+	}
+	return peer, false, nil
+}
+
+// RoutingErrorResponse is returned with 508 Loop Detected when a request
+// cannot be forwarded any further.
+type RoutingErrorResponse struct {
+	Key     string   `json:"key"`
+	Error   string   `json:"error"`
+	Hops    int      `json:"hops"`
+	Visited []string `json:"visited"`
+}
+
+// writeRoutingError reports a routing loop or hop limit to the client.
+func writeRoutingError(w http.ResponseWriter, r *http.Request, key, selfID string, rt route, err error) {
+	logging.RequestLogger(r.Context()).Warn("refusing to forward", "key", key, "hops", rt.hops, "err", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLoopDetected)
+	json.NewEncoder(w).Encode(RoutingErrorResponse{
+		Key:     key,
+		Error:   err.Error(),
+		Hops:    rt.hops,
+		Visited: append(slices.Clip(rt.visited), selfID),
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKademliaNextHop(t *testing.T) {
+	self := PeerInfo{NodeID: "5000000000000000", Address: "127.0.0.1:1005"}
+	n1 := PeerInfo{NodeID: "1000000000000000", Address: "127.0.0.1:1001"}
+	n9 := PeerInfo{NodeID: "9000000000000000", Address: "127.0.0.1:1009"}
+	nd := PeerInfo{NodeID: "d000000000000000", Address: "127.0.0.1:1013"}
+	pl := NewPeerList()
+	for _, p := range []PeerInfo{self, n1, n9, nd} {
+		pl.Add(p)
+	}
+	k := &Kademlia{selfID: self.NodeID, pl: pl, placement: xorPlacement{}}
+
+	tests := []struct {
+		name string
+		key  string
+		want string // "" for this node
+	}{
+		{"this node's ID", "5000000000000000", ""},
+		{"closest to this node", "5fffffffffffffff", ""},
+		{"closest to a peer", "1f00000000000000", "1000000000000000"},
+		{"a peer's ID", "9000000000000000", "9000000000000000"},
+		{"high bit set", "e000000000000000", "d000000000000000"},
+	}
+	for _, tt := range tests {
+		peer, isSelf := k.NextHop(tt.key)
+		if got := peer.NodeID; isSelf != (tt.want == "") || got != tt.want {
+			t.Errorf("%s: NextHop(%s) = %q, %v, want %q", tt.name, tt.key, got, isSelf, tt.want)
+		}
+	}
+
+	// A peer whose breaker is open is skipped for the next closest, and this
+	// node is responsible when it is closer than every peer left
+	openBreakers(t, n9.Address, n1.Address)
+	if peer, isSelf := k.NextHop("9000000000000000"); isSelf || peer.NodeID != nd.NodeID {
+		t.Errorf("with %s failing, NextHop = %q, %v, want %q", n9.NodeID, peer.NodeID, isSelf, nd.NodeID)
+	}
+	if peer, isSelf := k.NextHop("1000000000000000"); !isSelf {
+		t.Errorf("with %s failing, NextHop = %q, want this node", n1.NodeID, peer.NodeID)
+	}
+}
+
+// TestRoutersPutGet stores the same keys through each overlay and reads them
+// back from every node: each key must end up on exactly one node, the one
+// the overlay makes responsible for it.
+func TestRoutersPutGet(t *testing.T) {
+	ids := []string{"1000000000000000", "5000000000000000", "9000000000000000", "d000000000000000"}
+	keys := []string{"0000000000000001", "4fffffffffffffff", "5000000000000000", "7123456789abcdef", "c000000000000000", "ffffffffffffffff"}
+	for _, routing := range []string{routingKademlia, routingChord} {
+		t.Run(routing, func(t *testing.T) {
+			nodes := newTestCluster(t, routing, ids)
+			if routing == routingChord {
+				stabilizeRing(t, nodes)
+			}
+			for i, key := range keys {
+				value := fmt.Sprintf("value %d", i)
+				putKey(t, nodes[i%len(nodes)], key, value)
+				holders := 0
+				for _, n := range nodes {
+					if _, ok := n.store.Get(key); ok {
+						holders++
+						if _, isSelf := n.router.NextHop(key); !isSelf {
+							t.Errorf("key %s stored on %s, which is not responsible for it", key, n.id)
+						}
+					}
+				}
+				if holders != 1 {
+					t.Errorf("key %s stored on %d nodes, want 1", key, holders)
+				}
+				for _, n := range nodes {
+					if got, found := getKey(t, n, key); !found || got != value {
+						t.Errorf("get %s from %s = %q, %v, want %q", key, n.id, got, found, value)
+					}
+				}
+			}
+			if got, found := getKey(t, nodes[0], "3333333333333333"); found {
+				t.Errorf("get of a missing key found %q", got)
+			}
+		})
+	}
+}
+
+// testNode is a node served in-process, with the content, batch put, object
+// upload and Chord endpoints.
+type testNode struct {
+	id     string
+	adv    *Advertised
+	pl     *PeerList
+	store  *Store
+	router Router
+	srv    *httptest.Server
+}
+
+// newTestCluster starts a node for each ID with the given overlay. Kademlia
+// nodes know each other from the start; Chord nodes are left alone.
+func newTestCluster(t *testing.T, routing string, ids []string) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, len(ids))
+	for i, id := range ids {
+		mux := http.NewServeMux()
+		srv := httptest.NewUnstartedServer(mux)
+		adv, err := newAdvertised(srv.Listener.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &testNode{id: id, adv: adv, pl: NewPeerList(), store: NewStore(filepath.Join(t.TempDir(), "store.json"), id), srv: srv}
+		n.pl.Add(adv.Info(id))
+		if routing == routingChord {
+			chord := newChord(id, adv, n.pl, defaultChordSuccessors, defaultChordStabilizeInterval, time.Second)
+			mux.HandleFunc("/chord/state", chordStateHandler(chord))
+			mux.HandleFunc("/chord/notify", chordNotifyHandler(chord))
+			mux.HandleFunc("/chord/find_successor", chordFindSuccessorHandler(chord))
+			n.router = chord
+		} else {
+			n.router = &Kademlia{selfID: id, pl: n.pl, placement: xorPlacement{}}
+		}
+		mux.HandleFunc("/put", putContentHandler(n.store, n.router, id, adv, defaultMaxHops))
+		mux.HandleFunc("/get", getContentHandler(n.store, n.router, id, adv, defaultMaxHops))
+		mux.HandleFunc("/batch/put", batchPutHandler(n.store, n.router, id, defaultMaxHops))
+		mux.HandleFunc("POST /v1/objects", objectPostHandler(n.store, n.router, id, defaultMaxHops))
+		srv.Start()
+		t.Cleanup(srv.Close)
+		nodes[i] = n
+	}
+	if routing == routingKademlia {
+		for _, n := range nodes {
+			for _, other := range nodes {
+				n.pl.Add(other.adv.Info(other.id))
+			}
+		}
+	}
+	return nodes
+}
+
+func putKey(t *testing.T, n *testNode, key, value string) {
+	t.Helper()
+	buf, _ := json.Marshal(PutRequest{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value))})
+	resp, err := http.Post(n.srv.URL+"/put", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put %s through %s: %s", key, n.id, resp.Status)
+	}
+}
+
+func getKey(t *testing.T, n *testNode, key string) (string, bool) {
+	t.Helper()
+	resp, err := http.Get(n.srv.URL + "/get?key=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get %s through %s: %s", key, n.id, resp.Status)
+	}
+	var result GetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := base64.StdEncoding.DecodeString(result.Value)
+	return string(value), result.Found
+}
+
+// openBreakers replaces the peer client for the test with one whose breakers
+// for addrs are open.
+func openBreakers(t *testing.T, addrs ...string) {
+	t.Helper()
+	saved := peerClient
+	peerClient = newPeerClient(defaultPeerMaxInFlight, 1, time.Hour)
+	t.Cleanup(func() { peerClient = saved })
+	for _, addr := range addrs {
+		peerClient.failure(addr, peerClient.state(addr))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	routingTableFileName       = "routing_table.json"
+	defaultRoutingSaveInterval = time.Minute
+)
+
+// SavedPeer is a routing table entry as persisted in the data directory.
+type SavedPeer struct {
+	PeerInfo
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+type savedRoutingTable struct {
+	SavedAt time.Time   `json:"saved_at"`
+	Peers   []SavedPeer `json:"peers"`
+}
+
+// saveRoutingTable writes all peers except self to path, replacing the file
+// atomically so a crash never leaves a truncated table behind.
+func saveRoutingTable(path string, pl *PeerList, selfID string) error {
+	table := savedRoutingTable{SavedAt: time.Now().UTC()}
+	for _, p := range pl.Others(selfID) {
+		table.Peers = append(table.Peers, SavedPeer{PeerInfo: p, LastSeen: pl.LastSeen(p.NodeID)})
+	}
+	data, err := json.MarshalIndent(table, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistRoutingTable saves the routing table every interval until ctx is done.
+func persistRoutingTable(ctx context.Context, path string, pl *PeerList, selfID string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveRoutingTable(path, pl, selfID); err != nil {
+				slog.Warn("failed to save routing table", "file", path, "err", err)
+			}
+		}
+	}
+}
+
+// restoreRoutingTable loads the saved routing table from path and pings every
+// saved peer in parallel, each bounded by rpcTimeout. Peers that answer with
+// the node ID they were saved under are added to pl and returned; the rest
+// are dropped.
+func restoreRoutingTable(ctx context.Context, path string, pl *PeerList, selfID string, rpcTimeout time.Duration) []PeerInfo {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var table savedRoutingTable
+	if err == nil {
+		err = json.Unmarshal(data, &table)
+	}
+	if err != nil {
+		slog.Warn("cannot read saved routing table", "file", path, "err", err)
+		return nil
+	}
+	defer jobs.Start("restore_routing_table")()
+
+	var mu sync.Mutex
+	var live []PeerInfo
+	var wg sync.WaitGroup
+	for _, saved := range table.Peers {
+		if saved.NodeID == selfID {
+			continue
+		}
+		wg.Add(1)
+		go func(saved SavedPeer) {
+			defer wg.Done()
+			pingCtx, cancel := withRPCTimeout(ctx, rpcTimeout)
+			defer cancel()
+			pong, err := pingPeer(pingCtx, saved.Address)
+			peer := pong.PeerInfo
+			if err != nil || peer.NodeID != saved.NodeID {
+				slog.Debug("saved peer not reachable", "peer_id", saved.NodeID, "peer_addr", saved.Address, "last_seen", saved.LastSeen, "err", err)
+				return
+			}
+			pl.Add(peer)
+			pl.MarkSeen(peer.NodeID)
+			mu.Lock()
+			live = append(live, peer)
+			mu.Unlock()
+		}(saved)
+	}
+	wg.Wait()
+	slog.Info("restored routing table", "file", path, "saved", len(table.Peers), "live", len(live), "saved_at", table.SavedAt)
+	return live
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"dht-multiaddr"
+	"dht-swim"
+)
+
+// startTime is used to report the node's uptime.
+var startTime = time.Now()
+
+// rpcErrorWindow is how far back /status counts peer RPC errors.
+const rpcErrorWindow = 5 * time.Minute
+
+// jobs tracks background work that is currently running.
+var jobs = &jobTracker{running: make(map[string]int)}
+
+// rpcErrors records failed outbound calls per peer address.
+var rpcErrors = &rpcErrorLog{errors: make(map[string][]time.Time)}
+
+type jobTracker struct {
+	mu      sync.Mutex
+	running map[string]int // job name -> number of running instances
+}
+
+// Start marks a job as running. The returned function marks it as finished.
+func (jt *jobTracker) Start(name string) func() {
+	jt.mu.Lock()
+	jt.running[name]++
+	jt.mu.Unlock()
+	return func() {
+		jt.mu.Lock()
+		defer jt.mu.Unlock()
+		if jt.running[name]--; jt.running[name] <= 0 {
+			delete(jt.running, name)
+		}
+	}
+}
+
+// Snapshot returns the number of running instances per job name.
+func (jt *jobTracker) Snapshot() map[string]int {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	result := make(map[string]int, len(jt.running))
+	for k, v := range jt.running {
+		result[k] = v
+	}
+	return result
+}
+
+type rpcErrorLog struct {
+	mu     sync.Mutex
+	errors map[string][]time.Time // peer address -> error times
+}
+
+// Record notes a failed call to the peer at addr and drops entries older
+// than rpcErrorWindow, so the log stays bounded even when /status is never
+// requested.
+func (rl *rpcErrorLog) Record(addr string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.pruneLocked(now.Add(-rpcErrorWindow))
+	rl.errors[addr] = append(rl.errors[addr], now)
+	peerRPCFailures.Inc()
+}
+
+// Recent returns the number of errors per peer within rpcErrorWindow,
+// dropping older entries.
+func (rl *rpcErrorLog) Recent() map[string]int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.pruneLocked(time.Now().Add(-rpcErrorWindow))
+	result := make(map[string]int, len(rl.errors))
+	for addr, times := range rl.errors {
+		result[addr] = len(times)
+	}
+	return result
+}
+
+// pruneLocked drops the errors recorded before cutoff, and peers left with
+// none. The caller holds rl.mu.
+func (rl *rpcErrorLog) pruneLocked(cutoff time.Time) {
+	for addr, times := range rl.errors {
+		i := sort.Search(len(times), func(i int) bool { return times[i].After(cutoff) })
+		if i == len(times) {
+			delete(rl.errors, addr)
+		} else if i > 0 {
+			rl.errors[addr] = slices.Delete(times, 0, i)
+		}
+	}
+}
+
+// bucketIndex returns the Kademlia bucket a peer falls into relative to self:
+// the index of the highest bit in which the two IDs differ (-1 for self).
+func bucketIndex(selfID, peerID string) int {
+	return bits.Len64(xorDistance(selfID, peerID)) - 1
+}
+
+type StatusResponse struct {
+	NodeID          string            `json:"node_id"`
+	Addresses       []multiaddr.Addr  `json:"addresses"`
+	ObservedAddrs   map[string]int    `json:"observed_addrs"` // our address as seen by peers -> number of peers
+	UptimeSeconds   int64             `json:"uptime_seconds"`
+	Routing         string            `json:"routing"`             // routing overlay: kademlia or chord
+	Placement       string            `json:"placement,omitempty"` // placement strategy, with kademlia routing
+	Peers           int               `json:"peers"`
+	Buckets         map[int]int       `json:"buckets"` // bucket index -> peer count
+	Keys            int               `json:"keys"`
+	BytesStored     int               `json:"bytes_stored"`
+	Jobs            map[string]int    `json:"jobs"`
+	RecentRPCErrors map[string]int    `json:"recent_rpc_errors"` // peer address -> count in the last 5 minutes
+	OpenCircuits    map[string]string `json:"open_circuits"`     // peer address -> time the breaker opened
+	Join            JoinStatus        `json:"join"`
+	Members         map[string]int    `json:"members"` // failure detector state -> member count
+}
+
+type RoutingEntry struct {
+	NodeID      string           `json:"node_id"`
+	Address     string           `json:"address"`
+	Addresses   []multiaddr.Addr `json:"addresses,omitempty"`
+	Dialed      string           `json:"dialed,omitempty"` // address the last successful call went to
+	Distance    string           `json:"distance"`         // XOR distance from self, hex
+	Bucket      int              `json:"bucket"`
+	Circuit     string           `json:"circuit"` // "closed", or "open" while routing avoids the peer
+	LastSeen    time.Time        `json:"last_seen,omitzero"`
+	State       string           `json:"state,omitempty"` // failure detector state: alive or suspect
+	Incarnation uint64           `json:"incarnation"`     // raised by the peer each time it refutes a suspicion
+}
+
+// statusHandler handles GET /status, reporting what this node is doing.
+func statusHandler(store *Store, pl *PeerList, router Router, selfID string, adv *Advertised, membership *swim.Membership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peers := pl.Others(selfID)
+		buckets := make(map[int]int)
+		for _, p := range peers {
+			buckets[bucketIndex(selfID, p.NodeID)]++
+		}
+		keys, size := store.Stats()
+		circuits := make(map[string]string)
+		for addr, since := range peerClient.Circuits() {
+			circuits[addr] = since.UTC().Format(time.RFC3339)
+		}
+		resp := StatusResponse{
+			NodeID:          selfID,
+			Addresses:       adv.All(),
+			ObservedAddrs:   adv.Observations(),
+			UptimeSeconds:   int64(time.Since(startTime).Seconds()),
+			Routing:         router.Name(),
+			Peers:           len(peers),
+			Buckets:         buckets,
+			Keys:            keys,
+			BytesStored:     size,
+			Jobs:            jobs.Snapshot(),
+			RecentRPCErrors: rpcErrors.Recent(),
+			OpenCircuits:    circuits,
+			Join:            joinProgress.Snapshot(),
+			Members:         membership.Counts(),
+		}
+		if k, ok := router.(*Kademlia); ok {
+			resp.Placement = k.placement.Name()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// routingTableHandler handles GET /routing_table, listing peers by XOR distance from self.
+func routingTableHandler(pl *PeerList, selfID string, membership *swim.Membership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peers := pl.closestPeers(selfID, len(pl.All()), selfID)
+		entries := make([]RoutingEntry, 0, len(peers))
+		for _, p := range peers {
+			circuit := "closed"
+			if !peerClient.Available(p.Address) {
+				circuit = "open"
+			}
+			state, incarnation := membership.State(p.NodeID)
+			entries = append(entries, RoutingEntry{
+				NodeID:      p.NodeID,
+				Address:     p.Address,
+				Addresses:   p.Addresses,
+				Dialed:      peerClient.Dialed(p.Address),
+				Distance:    fmt.Sprintf("%016x", xorDistance(selfID, p.NodeID)),
+				Bucket:      bucketIndex(selfID, p.NodeID),
+				Circuit:     circuit,
+				LastSeen:    pl.LastSeen(p.NodeID),
+				State:       state,
+				Incarnation: incarnation,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
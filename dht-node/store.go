@@ -3,50 +3,120 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"os"
 	"sync"
+
+	"dht-version"
 )
 
+// ErrConflict is returned by Put when the expected version no longer matches.
+var ErrConflict = errors.New("version conflict")
+
 type Store struct {
-	mu   sync.RWMutex
-	data map[string][]byte
-	file string
+	mu     sync.RWMutex
+	data   map[string][]version.Versioned
+	file   string
+	nodeID string
 }
 
-func NewStore(nodeID string) *Store {
-	file := fmt.Sprintf("store_%s.json", nodeID)
+func NewStore(file, nodeID string) *Store {
 	return &Store{
-		data: make(map[string][]byte),
-		file: file,
+		data:   make(map[string][]version.Versioned),
+		file:   file,
+		nodeID: nodeID,
+	}
+}
+
+// Put stores value under key and returns its new version. If expected is
+// non-nil it must equal the key's current version, otherwise ErrConflict is
+// returned; an empty expected clock means the key must not exist yet.
+func (s *Store) Put(key string, value []byte, expected version.VectorClock) (version.VectorClock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := version.MergedClock(s.data[key])
+	if expected != nil && expected.Compare(current) != version.Equal {
+		return current, ErrConflict
+	}
+	return s.write(key, value, "", current)
+}
+
+// PutIf stores value under key only if cond holds, checking and writing
+// atomically under the store lock.
+func (s *Store) PutIf(key string, value []byte, cond version.Condition) (version.VectorClock, error) {
+	return s.PutObject(key, value, "", cond)
+}
+
+// PutObject is like PutIf but also records the content type of the value.
+func (s *Store) PutObject(key string, value []byte, contentType string, cond version.Condition) (version.VectorClock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	siblings := s.data[key]
+	current := version.MergedClock(siblings)
+	if !cond.Holds(siblings) {
+		return current, version.ErrPreconditionFailed
+	}
+	return s.write(key, value, contentType, current)
+}
+
+// Delete removes key if cond holds. It reports whether the key existed.
+func (s *Store) Delete(key string, cond version.Condition) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	siblings, ok := s.data[key]
+	if !cond.Holds(siblings) {
+		return ok, version.ErrPreconditionFailed
+	}
+	if !ok {
+		return false, nil
 	}
+	delete(s.data, key)
+	return true, s.save()
 }
 
-func (s *Store) Put(key string, value []byte) error {
+// write replaces all siblings of key with value. The caller must hold s.mu.
+func (s *Store) write(key string, value []byte, contentType string, current version.VectorClock) (version.VectorClock, error) {
+	clock := current.Increment(s.nodeID)
+	s.data[key] = []version.Versioned{{Value: value, ContentType: contentType, Clock: clock}}
+	return clock, s.save()
+}
+
+// Merge applies a value replicated from another node, keeping concurrent
+// values as siblings.
+func (s *Store) Merge(key string, v version.Versioned) ([]version.Versioned, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data[key] = value
-	return s.save()
+	s.data[key] = version.Reconcile(s.data[key], v)
+	return s.data[key], s.save()
 }
 
-func (s *Store) Get(key string) ([]byte, bool) {
+// Get returns all siblings stored under key.
+func (s *Store) Get(key string) ([]version.Versioned, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	v, ok := s.data[key]
 	return v, ok
 }
 
-func (s *Store) save() error {
-	tmp := make(map[string]string, len(s.data))
-	for k, v := range s.data {
-		tmp[k] = base64.StdEncoding.EncodeToString(v)
+// Stats returns the number of keys and the total size of all stored values.
+func (s *Store) Stats() (keys, bytes int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, siblings := range s.data {
+		for _, v := range siblings {
+			bytes += len(v.Value)
+		}
 	}
+	return len(s.data), bytes
+}
+
+func (s *Store) save() error {
 	f, err := os.Create(s.file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return json.NewEncoder(f).Encode(tmp)
+	return json.NewEncoder(f).Encode(s.data)
 }
 
 func (s *Store) Load() error {
@@ -55,16 +125,26 @@ func (s *Store) Load() error {
 		return err
 	}
 	defer f.Close()
-	var tmp map[string]string
+	var tmp map[string]json.RawMessage
 	if err := json.NewDecoder(f).Decode(&tmp); err != nil {
 		return err
 	}
-	for k, v := range tmp {
+	for k, raw := range tmp {
+		var siblings []version.Versioned
+		if err := json.Unmarshal(raw, &siblings); err == nil {
+			s.data[k] = siblings
+			continue
+		}
+		// Legacy format: base64-encoded value without a version
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
 		decoded, err := base64.StdEncoding.DecodeString(v)
 		if err != nil {
 			return err
 		}
-		s.data[k] = decoded
+		s.data[k] = []version.Versioned{{Value: decoded, Clock: version.VectorClock{}}}
 	}
 	return nil
 }
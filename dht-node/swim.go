@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"dht-swim"
+)
+
+// swimTable is the routing table as the failure detector sees it.
+type swimTable struct {
+	pl     *PeerList
+	selfID string
+}
+
+func (t swimTable) Members() []swim.Peer {
+	peers := t.pl.Others(t.selfID)
+	result := make([]swim.Peer, len(peers))
+	for i, p := range peers {
+		result[i] = swim.Peer{NodeID: p.NodeID, Address: p.Address}
+	}
+	return result
+}
+
+func (t swimTable) Lookup(nodeID string) (swim.Peer, bool) {
+	p, ok := t.pl.Get(nodeID)
+	return swim.Peer{NodeID: p.NodeID, Address: p.Address}, ok
+}
+
+func (t swimTable) Evict(nodeID string) {
+	t.pl.Remove(nodeID)
+}
+
+func (t swimTable) Seen(nodeID string) {
+	t.pl.MarkSeen(nodeID)
+}
+
+// swimClient sends probes through the peer client. They get through to a
+// peer whose breaker is open, so that a peer that is back is not suspected
+// again and its breaker closes.
+type swimClient struct{}
+
+func (swimClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := peerClient.Check(req)
+	if err != nil {
+		rpcErrors.Record(req.URL.Host)
+	}
+	return resp, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// traceHeader turns on hop-by-hop tracing for a put/get. Clients can set it
+// (or pass trace=1 in the query); forwarding nodes always pass it on.
+const traceHeader = "X-DHT-Trace"
+
+// Decisions recorded in a TraceHop.
+const (
+	decisionLocal     = "served_locally"
+	decisionForwarded = "forwarded"
+	decisionNotFound  = "not_found"
+)
+
+// TraceHop describes what one node did with a traced request.
+type TraceHop struct {
+	NodeID     string  `json:"node_id"`
+	Address    string  `json:"address"`
+	Distance   string  `json:"distance"` // from the node ID to the key, in the routing overlay's metric
+	Decision   string  `json:"decision"`
+	NextHop    string  `json:"next_hop,omitempty"` // peer address when forwarded
+	DurationMS float64 `json:"duration_ms"`        // includes time spent downstream
+}
+
+// traceable is implemented by responses that carry a trace.
+type traceable interface {
+	prependHop(hop TraceHop)
+}
+
+func (r *PutResponse) prependHop(hop TraceHop) {
+	r.Trace = append([]TraceHop{hop}, r.Trace...)
+}
+
+func (r *GetResponse) prependHop(hop TraceHop) {
+	r.Trace = append([]TraceHop{hop}, r.Trace...)
+}
+
+// tracer records this node's hop of a traced request. A nil tracer means
+// tracing is off, and all of its methods are no-ops.
+type tracer struct {
+	selfID   string
+	selfAddr string
+	distance uint64 // from this node to the key
+	start    time.Time
+}
+
+// newTracer returns a tracer if the request asked for tracing, nil otherwise.
+// Distances are measured in router's metric.
+func newTracer(r *http.Request, router Router, selfID, selfAddr, key string) *tracer {
+	q := r.URL.Query().Get("trace")
+	h := r.Header.Get(traceHeader)
+	if q != "1" && q != "true" && h != "1" && h != "true" {
+		return nil
+	}
+	return &tracer{selfID: selfID, selfAddr: selfAddr, distance: router.Distance(selfID, key), start: time.Now()}
+}
+
+// hop returns this node's hop with the time spent so far.
+func (t *tracer) hop(decision, nextHop string) TraceHop {
+	return TraceHop{
+		NodeID:     t.selfID,
+		Address:    t.selfAddr,
+		Distance:   fmt.Sprintf("%016x", t.distance),
+		Decision:   decision,
+		NextHop:    nextHop,
+		DurationMS: float64(time.Since(t.start).Microseconds()) / 1000,
+	}
+}
+
+// record adds this node's hop to a response answered locally.
+func (t *tracer) record(resp traceable, decision string) {
+	if t != nil {
+		resp.prependHop(t.hop(decision, ""))
+	}
+}
@@ -0,0 +1,15 @@
+module dht-pex
+
+go 1.24.3
+
+require (
+	dht-logging v0.0.0
+	dht-metrics v0.0.0
+	dht-multiaddr v0.0.0
+)
+
+replace (
+	dht-logging => ../dht-logging
+	dht-metrics => ../dht-metrics
+	dht-multiaddr => ../dht-multiaddr
+)
@@ -0,0 +1,271 @@
+// Package pex exchanges samples of the routing table with random peers, so
+// that nodes keep learning about nodes that joined after them. It is shared
+// by dht-node and dht-network, which serve its handler at /pex.
+package pex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"dht-logging"
+	"dht-metrics"
+	"dht-multiaddr"
+)
+
+// Defaults for the exchange interval given to Run and the options of New.
+const (
+	DefaultInterval   = 30 * time.Second
+	DefaultSampleSize = 8
+	DefaultMergeRate  = 30 // unknown peers checked per minute
+
+	// MaxSampleSize keeps a full sample well within maxMessageSize.
+	MaxSampleSize  = 64
+	maxMessageSize = 64 << 10
+)
+
+// ErrExchangeTimeout is the context cause of an exchange that got no answer
+// in time, so a Client can tell it from a caller that gave up.
+var ErrExchangeTimeout = errors.New("peer exchange timeout")
+
+var (
+	exchanges = metrics.NewCounter("dht_pex_exchanges_total",
+		"Peer exchanges started by this node, by result.", "result")
+	merges = metrics.NewCounter("dht_pex_merges_total",
+		"Unknown peers received through peer exchange, by outcome (added, unreachable, rate_limited).", "outcome")
+)
+
+// Peer is a peer as the routing table knows it, with the JSON form of the
+// nodes' PeerInfo.
+type Peer struct {
+	NodeID    string           `json:"node_id"`
+	Address   string           `json:"address"`             // primary address (host:port)
+	Addresses []multiaddr.Addr `json:"addresses,omitempty"` // every advertised address, in the peer's order of preference
+}
+
+// Table is the routing table the samples are taken from and merged into.
+type Table interface {
+	// Self returns this node as it announces itself.
+	Self() Peer
+	// Members returns every peer in the table except this node.
+	Members() []Peer
+	// Known reports whether the peer with nodeID is in the table.
+	Known(nodeID string) bool
+	// Seen records that the member with nodeID was just heard from directly.
+	Seen(nodeID string)
+	// IsSelf reports whether hostPort is one of this node's addresses.
+	IsSelf(hostPort string) bool
+	// AddIfLive pings p and adds it if it answers with its node ID.
+	AddIfLive(ctx context.Context, p Peer) bool
+}
+
+// Client sends exchanges to members.
+type Client interface {
+	Do(req *http.Request) (*http.Response, error)
+	// Available reports whether the member at hostPort is worth an exchange.
+	Available(hostPort string) bool
+}
+
+// Message is the body of a /pex request and of its response: the sender
+// and a random sample of its routing table.
+type Message struct {
+	From  Peer   `json:"from"`
+	Peers []Peer `json:"peers"`
+}
+
+// Exchange exchanges samples of the routing table with random peers. Peers
+// learned this way are only added once they answer a ping, and at most
+// mergeRate of them are checked per minute.
+type Exchange struct {
+	table      Table
+	client     Client
+	sampleSize int
+	rpcTimeout time.Duration
+
+	mu        sync.Mutex
+	mergeRate float64 // per minute
+	allowance tokenBucket
+	checking  map[string]bool // node IDs with a liveness check in progress
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64) float64 {
+	b.tokens = math.Min(rate, b.tokens+now.Sub(b.last).Minutes()*rate)
+	b.last = now
+	return b.tokens
+}
+
+// New returns the peer exchange over table, sending through client. Each
+// exchange is bounded by rpcTimeout.
+func New(table Table, client Client, sampleSize, mergeRate int, rpcTimeout time.Duration) *Exchange {
+	return &Exchange{
+		table:      table,
+		client:     client,
+		sampleSize: sampleSize,
+		rpcTimeout: rpcTimeout,
+		mergeRate:  float64(mergeRate),
+		allowance:  tokenBucket{tokens: float64(mergeRate), last: time.Now()},
+		checking:   make(map[string]bool),
+	}
+}
+
+// sample returns up to sampleSize known peers picked at random, leaving out
+// the peer with excludeID.
+func (x *Exchange) sample(excludeID string) []Peer {
+	peers := slices.DeleteFunc(x.table.Members(), func(p Peer) bool { return p.NodeID == excludeID })
+	rand.Shuffle(len(peers), func(a, b int) { peers[a], peers[b] = peers[b], peers[a] })
+	return peers[:min(len(peers), x.sampleSize)]
+}
+
+// Run exchanges samples with a random peer every interval until ctx is done.
+func (x *Exchange) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		peers := slices.DeleteFunc(x.table.Members(), func(p Peer) bool { return !x.client.Available(p.Address) })
+		if len(peers) == 0 {
+			continue
+		}
+		x.exchange(ctx, peers[rand.N(len(peers))])
+	}
+}
+
+// exchange sends a sample to peer and merges the sample it returns.
+func (x *Exchange) exchange(ctx context.Context, peer Peer) {
+	logger := slog.Default().With("component", "pex", "peer_id", peer.NodeID, "peer_addr", peer.Address)
+	reply, err := x.send(ctx, peer)
+	if err != nil {
+		logger.Debug("peer exchange failed", "err", err)
+		exchanges.Inc("failed")
+		return
+	}
+	exchanges.Inc("ok")
+	x.table.Seen(peer.NodeID)
+	logger.Debug("exchanged peers", "received", len(reply.Peers))
+	x.merge(ctx, reply.Peers[:min(len(reply.Peers), x.sampleSize)])
+}
+
+func (x *Exchange) send(ctx context.Context, peer Peer) (Message, error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, x.rpcTimeout, ErrExchangeTimeout)
+	defer cancel()
+	buf, _ := json.Marshal(Message{From: x.table.Self(), Peers: x.sample(peer.NodeID)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/pex", peer.Address), bytes.NewReader(buf))
+	if err != nil {
+		return Message{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	logging.SetRequestID(ctx, req)
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return Message{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Message{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var reply Message
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&reply)
+	return reply, err
+}
+
+// merge adds the peers not yet in the routing table that answer a ping with
+// their node ID. Peers beyond the merge rate are dropped; they will come up
+// again in later exchanges.
+func (x *Exchange) merge(ctx context.Context, peers []Peer) {
+	selfID := x.table.Self().NodeID
+	for _, p := range peers {
+		if p.Address == "" && len(p.Addresses) > 0 {
+			p.Address = p.Addresses[0].HostPort()
+		}
+		if p.NodeID == "" || p.NodeID == selfID || p.Address == "" || x.table.IsSelf(p.Address) {
+			continue
+		}
+		if x.table.Known(p.NodeID) || !x.startCheck(p.NodeID) {
+			continue
+		}
+		if !x.allow() {
+			x.endCheck(p.NodeID)
+			slog.Debug("peer exchange merge rate reached, dropping peer", "component", "pex", "peer_id", p.NodeID)
+			merges.Inc("rate_limited")
+			continue
+		}
+		if x.table.AddIfLive(ctx, p) {
+			slog.Info("learned peer through peer exchange", "component", "pex", "peer_id", p.NodeID, "peer_addr", p.Address)
+			merges.Inc("added")
+		} else {
+			merges.Inc("unreachable")
+		}
+		x.endCheck(p.NodeID)
+	}
+}
+
+// startCheck claims the liveness check of nodeID, so that concurrent
+// exchanges mentioning the same peer ping it only once.
+func (x *Exchange) startCheck(nodeID string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.checking[nodeID] {
+		return false
+	}
+	x.checking[nodeID] = true
+	return true
+}
+
+func (x *Exchange) endCheck(nodeID string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.checking, nodeID)
+}
+
+// allow takes one check from the merge allowance.
+func (x *Exchange) allow() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.allowance.refill(time.Now(), x.mergeRate) < 1 {
+		return false
+	}
+	x.allowance.tokens--
+	return true
+}
+
+// Handler answers a peer exchange with a sample of the routing table, then
+// merges the sender and its sample in the background.
+func Handler(x *Exchange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var msg Message
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&msg); err != nil || msg.From.NodeID == "" {
+			logging.RequestLogger(r.Context()).Warn("pex decode error", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Message{From: x.table.Self(), Peers: x.sample(msg.From.NodeID)})
+
+		// The sender goes first: it is the peer most likely to be new here
+		peers := append([]Peer{msg.From}, msg.Peers[:min(len(msg.Peers), x.sampleSize)]...)
+		go x.merge(context.WithoutCancel(r.Context()), peers)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"dht-server/dht"
+	"dht-server/name_mapper"
+)
+
+// BatchPutRequest represents the JSON body for /batch/put
+type BatchPutRequest struct {
+	Items []PutRequest `json:"items"`
+}
+
+// BatchGetRequest represents the JSON body for /batch/get
+// Keys and names can be mixed; names are resolved with the name-mapper.
+type BatchGetRequest struct {
+	Keys  []string `json:"keys,omitempty"`
+	Names []string `json:"names,omitempty"`
+}
+
+// BatchPutResult is one NDJSON line of the /batch/put response
+type BatchPutResult struct {
+	PutResponse
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchGetResult is one NDJSON line of the /batch/get response
+type BatchGetResult struct {
+	GetResponse
+	Name   string `json:"name,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ndjsonWriter writes one JSON object per line and flushes it to the client
+// right away so results are streamed as they are produced.
+type ndjsonWriter struct {
+	enc *json.Encoder
+	fl  http.Flusher
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fl, _ := w.(http.Flusher)
+	return &ndjsonWriter{enc: json.NewEncoder(w), fl: fl}
+}
+
+func (nw *ndjsonWriter) Write(v any) {
+	nw.enc.Encode(v)
+	if nw.fl != nil {
+		nw.fl.Flush()
+	}
+}
+
+// batchPutHandler handles POST /batch/put requests
+func batchPutHandler(dhtInst *dht.DHT, cluster *Cluster, nm *name_mapper.NameMapper, nameMapFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req BatchPutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out := newNDJSONWriter(w)
+		for _, item := range req.Items {
+			resp, status, msg := applyPut(r.Context(), dhtInst, cluster, nm, nameMapFile, item)
+			out.Write(BatchPutResult{PutResponse: resp, Name: item.Name, Status: status, Error: msg})
+		}
+	}
+}
+
+// batchGetHandler handles POST /batch/get requests
+func batchGetHandler(dhtInst *dht.DHT, cluster *Cluster, nm *name_mapper.NameMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req BatchGetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out := newNDJSONWriter(w)
+		for _, name := range req.Names {
+			key, ok := resolveName(cluster, nm, name)
+			if !ok {
+				out.Write(BatchGetResult{Name: name, Status: http.StatusNotFound, Error: "unknown name"})
+				continue
+			}
+			out.Write(batchGetResult(r.Context(), dhtInst, cluster, key, name))
+		}
+		for _, key := range req.Keys {
+			out.Write(batchGetResult(r.Context(), dhtInst, cluster, key, ""))
+		}
+	}
+}
+
+// batchGetResult looks up one key of a batch get.
+func batchGetResult(ctx context.Context, dhtInst *dht.DHT, cluster *Cluster, key, name string) BatchGetResult {
+	resp, err := lookup(ctx, dhtInst, cluster, key)
+	if err != nil {
+		return BatchGetResult{GetResponse: GetResponse{Key: key}, Name: name, Status: http.StatusBadGateway, Error: err.Error()}
+	}
+	return BatchGetResult{GetResponse: resp, Name: name, Status: http.StatusOK}
+}
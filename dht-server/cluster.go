@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"dht-logging"
+	"dht-metrics"
+	"dht-server/dht"
+	"dht-server/ring"
+	"dht-version"
+)
+
+const (
+	defaultClusterVnodes   = 64
+	defaultClusterReplicas = 2
+	defaultClusterReload   = 5 * time.Second
+	defaultClusterSweep    = time.Minute
+	defaultClusterTimeout  = 5 * time.Second
+	maxClusterVnodes       = 4096
+
+	// forwardedHeader marks a request forwarded by another member. It is
+	// served where it arrives, so members that briefly disagree about the
+	// ring cannot bounce a request between them.
+	forwardedHeader = "X-DHT-Forwarded"
+)
+
+var (
+	clusterForwarded = metrics.NewCounter("dht_cluster_forwarded_requests_total",
+		"Requests forwarded to the member owning the key, by operation.", "op")
+	clusterReplicationFailures = metrics.NewCounter("dht_cluster_replication_failures_total",
+		"Values that could not be copied to a replica, by member.", "member")
+	clusterTransferredKeys = metrics.NewCounter("dht_cluster_transferred_keys_total",
+		"Keys copied to new owners after a membership change or by a sweep.")
+)
+
+// ClusterConfig is the cluster file shared by all members.
+type ClusterConfig struct {
+	Members  []string `json:"members"`            // host:port of every member
+	Vnodes   int      `json:"vnodes,omitempty"`   // ring points per member
+	Replicas int      `json:"replicas,omitempty"` // copies of each key
+}
+
+// loadClusterConfig reads and validates a cluster file, filling in defaults.
+func loadClusterConfig(file string) (ClusterConfig, error) {
+	var cfg ClusterConfig
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", file, err)
+	}
+	if cfg.Vnodes == 0 {
+		cfg.Vnodes = defaultClusterVnodes
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = defaultClusterReplicas
+	}
+	switch {
+	case len(cfg.Members) == 0:
+		return cfg, fmt.Errorf("%s: no members", file)
+	case cfg.Vnodes < 1 || cfg.Vnodes > maxClusterVnodes:
+		return cfg, fmt.Errorf("%s: vnodes must be between 1 and %d, got %d", file, maxClusterVnodes, cfg.Vnodes)
+	case cfg.Replicas < 1:
+		return cfg, fmt.Errorf("%s: replicas must be at least 1, got %d", file, cfg.Replicas)
+	}
+	for _, m := range cfg.Members {
+		if _, _, err := net.SplitHostPort(m); err != nil {
+			return cfg, fmt.Errorf("%s: member %q: %w", file, m, err)
+		}
+	}
+	return cfg, nil
+}
+
+// placement is a ring together with the number of copies kept of each key.
+type placement struct {
+	ring     *ring.Ring
+	replicas int
+}
+
+func (p placement) owners(key string) []string {
+	return p.ring.Owners(key, p.replicas)
+}
+
+// Cluster routes requests over a static set of dht-server members. Each key
+// is owned by the first Replicas distinct members clockwise from it on a
+// consistent-hash ring. A member that is not an owner forwards the request to
+// the first owner that answers; an owner serves it and copies every write to
+// the other owners.
+//
+// The member list is read from a file, which is reloaded when it changes or
+// on SIGHUP. After a change, every member sends the keys it holds to their
+// new owners and drops the keys it no longer owns. A periodic sweep does the
+// same for keys that ended up outside their placement between changes.
+type Cluster struct {
+	self    string
+	file    string
+	dhtInst *dht.DHT
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	config   ClusterConfig
+	current  placement
+	settled  placement // placement all local keys are in; differs from current until a rebalance succeeds
+	modTime  time.Time
+	sequence int // bumped on every change of placement
+}
+
+func newCluster(file, self string, dhtInst *dht.DHT, timeout time.Duration) (*Cluster, error) {
+	cfg, err := loadClusterConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(cfg.Members, self) {
+		return nil, fmt.Errorf("%s: this server (%s) is not a member; set --advertise-addr to its address in the member list", file, self)
+	}
+	c := &Cluster{self: self, file: file, dhtInst: dhtInst, timeout: timeout}
+	if fi, err := os.Stat(file); err == nil {
+		c.modTime = fi.ModTime()
+	}
+	c.config = cfg
+	c.current = placement{ring.New(cfg.Members, cfg.Vnodes), cfg.Replicas}
+	c.settled = c.current
+	return c, nil
+}
+
+// Owners returns the members owning key, primary first.
+func (c *Cluster) Owners(key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current.owners(key)
+}
+
+// route returns the owners of key and whether the request must be forwarded
+// to one of them: this server is not an owner and the request was not already
+// forwarded by another member.
+func (c *Cluster) route(ctx context.Context, key string) ([]string, bool) {
+	owners := c.Owners(key)
+	return owners, forwardedBy(ctx) == "" && !slices.Contains(owners, c.self)
+}
+
+type ctxKey int
+
+const forwardedKey ctxKey = iota // cluster member that forwarded the request
+
+// isMember reports whether addr is in the current member list.
+func (c *Cluster) isMember(addr string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Contains(c.config.Members, addr)
+}
+
+// forwardedFrom returns the member named by the X-DHT-Forwarded header of r,
+// or "" unless it is a current member and the request comes from its host.
+// A member listed by name must resolve to the address the request comes from.
+func (c *Cluster) forwardedFrom(r *http.Request) string {
+	from := r.Header.Get(forwardedHeader)
+	if from == "" || !c.isMember(from) {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return ""
+	}
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	remote, err := netip.ParseAddr(remoteHost)
+	if err != nil {
+		return ""
+	}
+	hosts := []string{host}
+	if _, err := netip.ParseAddr(host); err != nil {
+		if hosts, err = net.DefaultResolver.LookupHost(r.Context(), host); err != nil {
+			return ""
+		}
+	}
+	for _, h := range hosts {
+		if a, err := netip.ParseAddr(h); err == nil && a.Unmap() == remote.Unmap() {
+			return from
+		}
+	}
+	logging.RequestLogger(r.Context()).Warn("ignoring forwarded header from another host", "member", from, "remote_addr", r.RemoteAddr)
+	return ""
+}
+
+// markForwarded records in the request context which member, if any,
+// forwarded the request. The header is only honoured from a current member's
+// host; any other request is routed as a client's, so it cannot make a server
+// answer for keys it does not own.
+func markForwarded(c *Cluster, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c == nil {
+			next(w, r)
+			return
+		}
+		if from := c.forwardedFrom(r); from != "" {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedKey, from))
+		}
+		next(w, r)
+	}
+}
+
+// forwardedBy returns the member that forwarded the request of ctx, or "".
+func forwardedBy(ctx context.Context) string {
+	from, _ := ctx.Value(forwardedKey).(string)
+	return from
+}
+
+// newRequest builds a request to another member, marked as forwarded and
+// carrying the request ID of ctx.
+func (c *Cluster) newRequest(ctx context.Context, method, member, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+member+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(forwardedHeader, c.self)
+	logging.SetRequestID(ctx, req)
+	return req, nil
+}
+
+// call sends a request to member, bounded by the cluster timeout, and
+// returns the status and body of the response.
+func (c *Cluster) call(ctx context.Context, method, member, path string, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, method, member, path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// forwardPut sends a put of key to the first owner that answers.
+func (c *Cluster) forwardPut(ctx context.Context, owners []string, key string, req PutRequest) (PutResponse, int, string) {
+	body, _ := json.Marshal(req)
+	for _, m := range owners {
+		status, data, err := c.call(ctx, http.MethodPost, m, "/put", body)
+		if err != nil {
+			logging.RequestLogger(ctx).Warn("owner not reachable, trying next", "member", m, "err", err)
+			continue
+		}
+		clusterForwarded.Inc("put")
+		if status != http.StatusOK {
+			return PutResponse{Key: key}, status, string(data)
+		}
+		var resp PutResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return PutResponse{Key: key}, http.StatusBadGateway, "bad response from owner"
+		}
+		return resp, http.StatusOK, ""
+	}
+	return PutResponse{Key: key}, http.StatusBadGateway, "no owner of the key is reachable"
+}
+
+// forwardGet reads key from the first owner that answers.
+func (c *Cluster) forwardGet(ctx context.Context, owners []string, key string) (GetResponse, error) {
+	var lastErr error
+	for _, m := range owners {
+		status, data, err := c.call(ctx, http.MethodGet, m, "/get?key="+url.QueryEscape(key), nil)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("unexpected status %d", status)
+		}
+		if err != nil {
+			logging.RequestLogger(ctx).Warn("owner not reachable, trying next", "member", m, "err", err)
+			lastErr = err
+			continue
+		}
+		clusterForwarded.Inc("get")
+		var resp GetResponse
+		err = json.Unmarshal(data, &resp)
+		return resp, err
+	}
+	return GetResponse{}, fmt.Errorf("no owner of the key is reachable: %w", lastErr)
+}
+
+// holders returns the members that may hold key: its owners in the current
+// placement, then those of the settled placement that are not owners now.
+func (c *Cluster) holders(key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	members := c.current.owners(key)
+	for _, m := range c.settled.owners(key) {
+		if !slices.Contains(members, m) {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+// gather reads key from every member that may hold it, this one included,
+// and merges the siblings of those that have it. It is used when the owner
+// asked first does not have the key, which it may not have received yet: a
+// replica misses writes while it is down, and keys reach their new owners
+// some time after a membership change.
+func (c *Cluster) gather(ctx context.Context, key string) (GetResponse, error) {
+	var siblings []version.Versioned
+	found, reached := false, 0
+	var lastErr error
+	for _, m := range c.holders(key) {
+		var resp GetResponse
+		if m == c.self {
+			var local []version.Versioned
+			local, resp.Found = c.dhtInst.Get(key)
+			resp.Siblings = local
+		} else {
+			status, data, err := c.call(ctx, http.MethodGet, m, "/get?key="+url.QueryEscape(key), nil)
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", status)
+			}
+			if err == nil {
+				err = json.Unmarshal(data, &resp)
+			}
+			if err != nil {
+				logging.RequestLogger(ctx).Warn("member not reachable, reading from the others", "member", m, "err", err)
+				lastErr = err
+				continue
+			}
+			clusterForwarded.Inc("get")
+		}
+		reached++
+		if !resp.Found {
+			continue
+		}
+		found = true
+		for _, v := range resp.versions() {
+			siblings = version.Reconcile(siblings, v)
+		}
+	}
+	if reached == 0 {
+		return GetResponse{}, fmt.Errorf("no member holding the key is reachable: %w", lastErr)
+	}
+	return newGetResponse(key, siblings, found), nil
+}
+
+// versions returns the siblings of a response, which lists them only when
+// there are several.
+func (r GetResponse) versions() []version.Versioned {
+	if len(r.Siblings) > 0 {
+		return r.Siblings
+	}
+	value, _ := base64.StdEncoding.DecodeString(r.Value)
+	return []version.Versioned{{Value: value, ContentType: r.ContentType, Clock: r.Version}}
+}
+
+// proxy passes a raw object request on to the first owner that answers and
+// copies its response back.
+func (c *Cluster) proxy(w http.ResponseWriter, r *http.Request, owners []string, body []byte) {
+	for _, m := range owners {
+		ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+		req, err := c.newRequest(ctx, r.Method, m, r.URL.RequestURI(), body)
+		if err != nil {
+			cancel()
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, h := range []string{"Content-Type", "If-Match", "If-None-Match", "Range"} {
+			if v := r.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			cancel()
+			logging.RequestLogger(r.Context()).Warn("owner not reachable, trying next", "member", m, "err", err)
+			continue
+		}
+		clusterForwarded.Inc("object")
+		for _, h := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Location"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+		cancel()
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write([]byte("no owner of the key is reachable"))
+}
+
+// replicate copies the siblings of key to members and returns the members
+// that could not be reached.
+func (c *Cluster) replicate(ctx context.Context, key string, siblings []version.Versioned, members []string) []string {
+	var failed []string
+	for _, m := range members {
+		for _, v := range siblings {
+			body, _ := json.Marshal(ReplicateRequest{Key: key, Versioned: v})
+			status, _, err := c.call(ctx, http.MethodPost, m, "/replicate", body)
+			if err == nil && status != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", status)
+			}
+			if err != nil {
+				logging.RequestLogger(ctx).Warn("replication failed", "key", key, "member", m, "err", err)
+				clusterReplicationFailures.Inc(m)
+				failed = append(failed, m)
+				break
+			}
+		}
+	}
+	return failed
+}
+
+// replicateWrite copies key to its other owners after a local write. A replica
+// that is down misses the write; it gets the key again on the next write.
+func (c *Cluster) replicateWrite(ctx context.Context, key string) {
+	siblings, ok := c.dhtInst.Get(key)
+	if !ok {
+		return
+	}
+	c.replicate(ctx, key, siblings, slices.DeleteFunc(c.Owners(key), func(m string) bool { return m == c.self }))
+}
+
+// replicateDelete passes a successful object delete on to the other owners,
+// unless it is itself a delete passed on by an owner.
+func (c *Cluster) replicateDelete(ctx context.Context, key string) {
+	owners := c.Owners(key)
+	if slices.Contains(owners, forwardedBy(ctx)) {
+		return
+	}
+	for _, m := range owners {
+		if m == c.self {
+			continue
+		}
+		status, _, err := c.call(ctx, http.MethodDelete, m, "/v1/objects/"+url.PathEscape(key), nil)
+		if err == nil && status != http.StatusNoContent && status != http.StatusNotFound {
+			err = fmt.Errorf("unexpected status %d", status)
+		}
+		if err != nil {
+			logging.RequestLogger(ctx).Warn("replicating delete failed", "key", key, "member", m, "err", err)
+			clusterReplicationFailures.Inc(m)
+		}
+	}
+}
+
+// reload reads the cluster file again if it changed since the last load, or
+// always if force is set. An invalid file is logged and ignored.
+func (c *Cluster) reload(force bool) {
+	fi, err := os.Stat(c.file)
+	if err != nil {
+		slog.Error("cannot read cluster file", "file", c.file, "err", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !force && fi.ModTime().Equal(c.modTime) {
+		return
+	}
+	c.modTime = fi.ModTime()
+	cfg, err := loadClusterConfig(c.file)
+	if err != nil {
+		slog.Error("invalid cluster file, keeping the current members", "err", err)
+		return
+	}
+	if slices.Equal(cfg.Members, c.config.Members) && cfg.Vnodes == c.config.Vnodes && cfg.Replicas == c.config.Replicas {
+		return
+	}
+	if !slices.Contains(cfg.Members, c.self) {
+		slog.Warn("this server is no longer a cluster member, handing off its keys", "self", c.self)
+	}
+	slog.Info("cluster membership changed", "members", cfg.Members, "vnodes", cfg.Vnodes, "replicas", cfg.Replicas)
+	c.config = cfg
+	c.current = placement{ring.New(cfg.Members, cfg.Vnodes), cfg.Replicas}
+	c.sequence++
+}
+
+// rebalance sends each local key to the members that own it now but did not
+// own it in the settled placement, and deletes the keys this server no longer
+// owns once their new owners have them. A key that is handed off goes to all
+// its owners, since they may not all have it. If any key could not be moved,
+// the settled placement is kept and the next call tries again.
+//
+// With sweep set it also runs when the placement did not change, handing off
+// keys held outside their placement: a write forwarded by a member with a
+// different member list is stored where it arrives, and a replica can receive
+// a key after it was handed off.
+func (c *Cluster) rebalance(ctx context.Context, sweep bool) {
+	c.mu.RLock()
+	from, to, sequence := c.settled, c.current, c.sequence
+	c.mu.RUnlock()
+	if from == to && !sweep {
+		return
+	}
+	keys, _ := c.dhtInst.Keys("", "", 0, false)
+	moved, pending := 0, 0
+	for _, k := range keys {
+		oldOwners, newOwners := from.owners(k.Key), to.owners(k.Key)
+		owner := slices.Contains(newOwners, c.self)
+		var targets []string
+		for _, m := range newOwners {
+			if m != c.self && (!owner || !slices.Contains(oldOwners, m)) {
+				targets = append(targets, m)
+			}
+		}
+		siblings, ok := c.dhtInst.Get(k.Key)
+		if !ok {
+			continue
+		}
+		if failed := c.replicate(ctx, k.Key, siblings, targets); len(failed) > 0 {
+			pending++
+			continue
+		}
+		if len(targets) > 0 {
+			moved++
+			clusterTransferredKeys.Inc()
+		}
+		if !owner {
+			// A write that arrived since the copy keeps the key for the next round
+			if _, err := c.dhtInst.Delete(k.Key, version.Condition{IfVersion: version.MergedClock(siblings)}); errors.Is(err, version.ErrPreconditionFailed) {
+				pending++
+			}
+		}
+	}
+	if pending > 0 {
+		slog.Warn("rebalance incomplete, retrying", "moved", moved, "pending", pending)
+		return
+	}
+	if from == to {
+		if moved > 0 {
+			slog.Info("handed off misplaced keys", "moved", moved)
+		}
+		return
+	}
+	c.mu.Lock()
+	if c.sequence == sequence {
+		c.settled = to
+	}
+	c.mu.Unlock()
+	slog.Info("rebalance done", "moved", moved)
+}
+
+// Run reloads the cluster file when it changes or on SIGHUP, checking every
+// interval, and moves keys after each change until ctx is done. Every
+// sweepInterval it also hands off keys held outside their placement.
+func (c *Cluster) Run(ctx context.Context, interval, sweepInterval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sweeper := time.NewTicker(sweepInterval)
+	defer sweeper.Stop()
+	for {
+		force, sweep := false, false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			force = true
+		case <-ticker.C:
+		case <-sweeper.C:
+			sweep = true
+		}
+		c.reload(force)
+		c.rebalance(ctx, sweep)
+	}
+}
+
+// ClusterStatus is the /cluster response.
+type ClusterStatus struct {
+	Self        string   `json:"self"`
+	Members     []string `json:"members"`
+	Vnodes      int      `json:"vnodes"`
+	Replicas    int      `json:"replicas"`
+	Rebalancing bool     `json:"rebalancing"`      // keys are still being moved after a change
+	Key         string   `json:"key,omitempty"`    // with ?key=
+	Owners      []string `json:"owners,omitempty"` // owners of key, primary first
+}
+
+// clusterHandler handles GET /cluster, optionally with ?key= to show the
+// owners of a key.
+func clusterHandler(c *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		status := ClusterStatus{
+			Self:        c.self,
+			Members:     slices.Clone(c.config.Members),
+			Vnodes:      c.config.Vnodes,
+			Replicas:    c.config.Replicas,
+			Rebalancing: c.settled != c.current,
+		}
+		c.mu.RUnlock()
+		if key := r.URL.Query().Get("key"); key != "" {
+			status.Key, status.Owners = key, c.Owners(key)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"dht-server/dht"
+	"dht-server/name_mapper"
+	"dht-version"
+)
+
+// testMember is a cluster member served in-process.
+type testMember struct {
+	addr    string
+	dhtInst *dht.DHT
+	cluster *Cluster
+	srv     *httptest.Server
+}
+
+// newTestMembers starts n servers sharing one cluster file, of which the
+// first listed are members. It returns the servers and the cluster file.
+func newTestMembers(t *testing.T, n, listed, replicas int) ([]*testMember, string) {
+	t.Helper()
+	dir := t.TempDir()
+	members := make([]*testMember, n)
+	var addrs []string
+	for i := range members {
+		srv := httptest.NewUnstartedServer(nil)
+		members[i] = &testMember{addr: srv.Listener.Addr().String(), srv: srv}
+		addrs = append(addrs, members[i].addr)
+	}
+	file := filepath.Join(dir, "cluster.json")
+	writeClusterFile(t, file, addrs[:listed], replicas)
+	for i, m := range members {
+		m.dhtInst = dht.NewDHT(m.addr, filepath.Join(dir, fmt.Sprintf("store%d.json", i)))
+		// Servers not listed yet join with the full list, then take the file's
+		cfg := file
+		if i >= listed {
+			cfg = filepath.Join(dir, fmt.Sprintf("cluster%d.json", i))
+			writeClusterFile(t, cfg, addrs, replicas)
+		}
+		var err error
+		if m.cluster, err = newCluster(cfg, m.addr, m.dhtInst, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		m.cluster.file = file
+		m.cluster.reload(true)
+		m.cluster.settled = m.cluster.current
+		nm := name_mapper.NewNameMapper()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/put", markForwarded(m.cluster, putHandler(m.dhtInst, m.cluster, nm, filepath.Join(dir, fmt.Sprintf("names%d.json", i)))))
+		mux.HandleFunc("/get", markForwarded(m.cluster, getHandler(m.dhtInst, m.cluster, nm)))
+		mux.HandleFunc("/replicate", markForwarded(m.cluster, replicateHandler(m.dhtInst)))
+		m.srv.Config.Handler = mux
+		m.srv.Start()
+		t.Cleanup(m.srv.Close)
+	}
+	return members, file
+}
+
+func writeClusterFile(t *testing.T, file string, members []string, replicas int) {
+	t.Helper()
+	data, _ := json.Marshal(ClusterConfig{Members: members, Vnodes: 16, Replicas: replicas})
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changeMembers rewrites the cluster file and has every server reload it.
+func changeMembers(t *testing.T, members []*testMember, file string, listed []*testMember, replicas int) {
+	t.Helper()
+	var addrs []string
+	for _, m := range listed {
+		addrs = append(addrs, m.addr)
+	}
+	writeClusterFile(t, file, addrs, replicas)
+	for _, m := range members {
+		m.cluster.reload(true)
+	}
+}
+
+func (m *testMember) put(t *testing.T, key, value string) {
+	t.Helper()
+	buf, _ := json.Marshal(PutRequest{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value))})
+	resp, err := http.Post(m.srv.URL+"/put", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put %s through %s: %s", key, m.addr, resp.Status)
+	}
+}
+
+// postPut posts a raw /put body and returns the status.
+func (m *testMember) postPut(t *testing.T, body string) int {
+	t.Helper()
+	resp, err := http.Post(m.srv.URL+"/put", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (m *testMember) get(t *testing.T, key string) (string, bool) {
+	t.Helper()
+	resp, err := http.Get(m.srv.URL + "/get?key=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get %s through %s: %s", key, m.addr, resp.Status)
+	}
+	var result GetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := base64.StdEncoding.DecodeString(result.Value)
+	return string(value), result.Found
+}
+
+// holding returns the addresses of the members whose store has key.
+func holding(members []*testMember, key string) []string {
+	var addrs []string
+	for _, m := range members {
+		if _, ok := m.dhtInst.Get(key); ok {
+			addrs = append(addrs, m.addr)
+		}
+	}
+	return addrs
+}
+
+// checkPlaced fails unless each key is held by exactly its owners.
+func checkPlaced(t *testing.T, members []*testMember, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		owners, got := members[0].cluster.Owners(key), holding(members, key)
+		slices.Sort(owners)
+		slices.Sort(got)
+		if !slices.Equal(got, owners) {
+			t.Errorf("key %s held by %v, want its owners %v", key, got, owners)
+		}
+	}
+}
+
+func TestRebalanceOnAdd(t *testing.T) {
+	members, file := newTestMembers(t, 4, 3, 2)
+	var keys []string
+	for i := range 50 {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+		members[i%3].put(t, keys[i], "value")
+	}
+	checkPlaced(t, members, keys)
+
+	changeMembers(t, members, file, members, 2)
+	for _, m := range members {
+		m.cluster.rebalance(context.Background(), false)
+	}
+	checkPlaced(t, members, keys)
+	if n, _ := members[3].dhtInst.Stats(); n == 0 {
+		t.Error("the new member received no keys")
+	}
+	for _, m := range members {
+		if m.cluster.settled != m.cluster.current {
+			t.Errorf("%s: rebalance did not settle", m.addr)
+		}
+	}
+}
+
+func TestRebalanceOnRemove(t *testing.T) {
+	members, file := newTestMembers(t, 3, 3, 2)
+	var keys []string
+	for i := range 50 {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+		members[i%3].put(t, keys[i], "value")
+	}
+
+	removed := members[2]
+	changeMembers(t, members, file, members[:2], 2)
+	for _, m := range members {
+		m.cluster.rebalance(context.Background(), false)
+	}
+	if n, _ := removed.dhtInst.Stats(); n != 0 {
+		t.Errorf("the removed member still holds %d keys", n)
+	}
+	// With two members and two replicas, both hold every key
+	for _, key := range keys {
+		if got := holding(members[:2], key); len(got) != 2 {
+			t.Errorf("key %s held by %v, want both members", key, got)
+		}
+	}
+}
+
+func TestRebalanceSweep(t *testing.T) {
+	members, _ := newTestMembers(t, 3, 3, 1)
+	key := "misplaced"
+	owner := members[0].cluster.Owners(key)[0]
+	var other *testMember
+	for _, m := range members {
+		if m.addr != owner {
+			other = m
+		}
+	}
+	if _, err := other.dhtInst.Put(key, []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a change of placement only a sweep moves it
+	other.cluster.rebalance(context.Background(), false)
+	if got := holding(members, key); !slices.Equal(got, []string{other.addr}) {
+		t.Fatalf("without a sweep, key held by %v, want %s", got, other.addr)
+	}
+	other.cluster.rebalance(context.Background(), true)
+	if got := holding(members, key); !slices.Equal(got, []string{owner}) {
+		t.Errorf("after a sweep, key held by %v, want %s", got, owner)
+	}
+}
+
+func TestLookupAsksOtherOwners(t *testing.T) {
+	members, _ := newTestMembers(t, 3, 3, 2)
+	key := "key"
+	members[0].put(t, key, "value")
+	owners := members[0].cluster.Owners(key)
+
+	// The first owner missed the write, as if it had been down
+	var first *testMember
+	for _, m := range members {
+		if m.addr == owners[0] {
+			first = m
+		}
+	}
+	if _, err := first.dhtInst.Delete(key, version.Condition{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if got, found := m.get(t, key); !found || got != "value" {
+			t.Errorf("get through %s = %q, %v, want the value", m.addr, got, found)
+		}
+	}
+	if _, found := members[0].get(t, "missing"); found {
+		t.Error("a missing key was found")
+	}
+}
+
+func TestLookupAsksSettledOwners(t *testing.T) {
+	members, file := newTestMembers(t, 4, 3, 1)
+	// A key that moves to the new member, before the move
+	var key string
+	changeMembers(t, members, file, members, 1)
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key-%d", i); members[0].cluster.Owners(k)[0] == members[3].addr {
+			key = k
+		}
+	}
+	changeMembers(t, members, file, members[:3], 1)
+	members[0].put(t, key, "value")
+
+	changeMembers(t, members, file, members, 1)
+	for _, m := range members {
+		if got, found := m.get(t, key); !found || got != "value" {
+			t.Errorf("get through %s before the move = %q, %v, want the value", m.addr, got, found)
+		}
+	}
+}
+
+func TestMarkForwarded(t *testing.T) {
+	members, _ := newTestMembers(t, 2, 2, 1)
+	c := members[0].cluster
+	tests := []struct {
+		header string
+		remote string
+		want   string
+	}{
+		{"", "127.0.0.1:40000", ""},
+		{members[1].addr, "127.0.0.1:40000", members[1].addr},
+		{"10.0.0.1:8080", "10.0.0.1:40000", ""},
+		// A client naming a real member is not taken for it
+		{members[1].addr, "192.0.2.1:40000", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		h := markForwarded(c, func(w http.ResponseWriter, r *http.Request) { got = forwardedBy(r.Context()) })
+		r := httptest.NewRequest(http.MethodGet, "/get?key=k", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set(forwardedHeader, tt.header)
+		}
+		h(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("forwarded by %q from %s: forwardedBy = %q, want %q", tt.header, tt.remote, got, tt.want)
+		}
+	}
+	// Outside cluster mode the header means nothing
+	var got string
+	h := markForwarded(nil, func(w http.ResponseWriter, r *http.Request) { got = forwardedBy(r.Context()) })
+	r := httptest.NewRequest(http.MethodGet, "/get?key=k", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set(forwardedHeader, members[1].addr)
+	h(httptest.NewRecorder(), r)
+	if got != "" {
+		t.Errorf("without a cluster, forwardedBy = %q, want none", got)
+	}
+}
+
+func TestForwardedCreateOnlyPut(t *testing.T) {
+	members, _ := newTestMembers(t, 3, 3, 1)
+	key := "key"
+	owner := members[0].cluster.Owners(key)[0]
+	var other *testMember
+	for _, m := range members {
+		if m.addr != owner {
+			other = m
+		}
+	}
+	other.put(t, key, "first")
+
+	// An empty version or if_version means the key must not exist, also
+	// when a member forwards the put to the owner
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"key":"key","value":"c2Vjb25k","version":{}}`, http.StatusConflict},
+		{`{"key":"key","value":"c2Vjb25k","condition":{"if_version":{}}}`, http.StatusPreconditionFailed},
+		{`{"key":"key","value":"c2Vjb25k","condition":{}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status := other.postPut(t, tt.body); status != tt.want {
+			t.Errorf("put %s through a non-owner: status %d, want %d", tt.body, status, tt.want)
+		}
+	}
+	if got, _ := other.get(t, key); got != "first" {
+		t.Errorf("value after refused puts = %q, want %q", got, "first")
+	}
+}
+
+// getVersion returns the JSON of the current version of key.
+func (m *testMember) getVersion(t *testing.T, key string) string {
+	t.Helper()
+	resp, err := http.Get(m.srv.URL + "/get?key=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result GetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(result.Version)
+	return string(buf)
+}
+
+// TestConditionalPut checks every kind of precondition, sent to the owner of
+// the key and forwarded by another member. Each case writes "zero", then
+// "first" unless the key should be missing, and puts "second" with the
+// case's version or condition.
+func TestConditionalPut(t *testing.T) {
+	members, _ := newTestMembers(t, 3, 3, 1)
+	hash := func(s string) string { return `"` + version.HashValue([]byte(s)) + `"` }
+	tests := []struct {
+		name    string
+		missing bool
+		put     string // $current is the current version, $stale the version before "first"
+		want    int
+	}{
+		{"current version", false, `"version":$current`, http.StatusOK},
+		{"stale version", false, `"version":$stale`, http.StatusConflict},
+		{"if_version current", false, `"condition":{"if_version":$current}`, http.StatusOK},
+		{"if_version stale", false, `"condition":{"if_version":$stale}`, http.StatusPreconditionFailed},
+		{"if_hash current", false, `"condition":{"if_hash":` + hash("first") + `}`, http.StatusOK},
+		{"if_hash stale", false, `"condition":{"if_hash":` + hash("zero") + `}`, http.StatusPreconditionFailed},
+		{"if_absent present", false, `"condition":{"if_absent":true}`, http.StatusPreconditionFailed},
+		{"if_absent missing", true, `"condition":{"if_absent":true}`, http.StatusOK},
+		{"if_present present", false, `"condition":{"if_present":true}`, http.StatusOK},
+		{"if_present missing", true, `"condition":{"if_present":true}`, http.StatusPreconditionFailed},
+	}
+	for _, via := range []string{"owner", "forwarded"} {
+		for i, tt := range tests {
+			key := fmt.Sprintf("%s-%d", via, i)
+			owner := members[0].cluster.Owners(key)[0]
+			var n *testMember
+			for _, m := range members {
+				if (m.addr == owner) == (via == "owner") {
+					n = m
+				}
+			}
+			stale := "{}"
+			if !tt.missing {
+				n.put(t, key, "zero")
+				stale = n.getVersion(t, key)
+				n.put(t, key, "first")
+			}
+			current := n.getVersion(t, key)
+			body := `{"key":"` + key + `","value":"c2Vjb25k",` + strings.NewReplacer("$current", current, "$stale", stale).Replace(tt.put) + `}`
+			if status := n.postPut(t, body); status != tt.want {
+				t.Errorf("%s, %s: status %d, want %d", via, tt.name, status, tt.want)
+			}
+			want := "first"
+			if tt.missing {
+				want = ""
+			}
+			if tt.want == http.StatusOK {
+				want = "second"
+			}
+			if got, _ := n.get(t, key); got != want {
+				t.Errorf("%s, %s: value %q, want %q", via, tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestLookupKeepsContentType(t *testing.T) {
+	members, _ := newTestMembers(t, 3, 3, 2)
+	key := "object"
+	owners := members[0].cluster.Owners(key)
+	// Only the second owner has the value, so every read gathers it
+	for _, m := range members {
+		if m.addr == owners[1] {
+			if _, err := m.dhtInst.PutObject(key, []byte("text"), "text/plain", version.Condition{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, m := range members {
+		resp, err := http.Get(m.srv.URL + "/get?key=" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result GetResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || !result.Found || result.ContentType != "text/plain" {
+			t.Errorf("get through %s = %+v (%v), want the value with its content type", m.addr, result, err)
+		}
+	}
+}
@@ -5,13 +5,19 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+
+	"dht-version"
 )
 
+// ErrConflict is returned by Put when the expected version no longer matches.
+var ErrConflict = errors.New("version conflict")
+
 type DHT struct {
-	store       map[string][]byte
+	store       map[string][]version.Versioned
 	mu          sync.RWMutex
 	NodeID      string
 	persistFile string
@@ -21,7 +27,7 @@ func NewDHT(serverURI, persistFile string) *DHT {
 	h := sha1.Sum([]byte(serverURI))
 	id := binary.BigEndian.Uint64(h[:8])
 	d := &DHT{
-		store:       make(map[string][]byte),
+		store:       make(map[string][]version.Versioned),
 		NodeID:      fmt.Sprintf("%016x", id),
 		persistFile: persistFile,
 	}
@@ -29,30 +35,97 @@ func NewDHT(serverURI, persistFile string) *DHT {
 	return d
 }
 
-func (d *DHT) Put(key string, value []byte) {
+// Put stores value under key and returns its new version. If expected is
+// non-nil it must equal the key's current version, otherwise ErrConflict is
+// returned; an empty expected clock means the key must not exist yet.
+// A successful Put replaces all siblings.
+func (d *DHT) Put(key string, value []byte, expected version.VectorClock) (version.VectorClock, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current := version.MergedClock(d.store[key])
+	if expected != nil && expected.Compare(current) != version.Equal {
+		return current, ErrConflict
+	}
+	return d.write(key, value, "", current), nil
+}
+
+// PutIf stores value under key only if cond holds for the current value.
+// The check and the write happen atomically under the DHT lock.
+func (d *DHT) PutIf(key string, value []byte, cond version.Condition) (version.VectorClock, error) {
+	return d.PutObject(key, value, "", cond)
+}
+
+// PutObject is like PutIf but also records the content type of the value.
+func (d *DHT) PutObject(key string, value []byte, contentType string, cond version.Condition) (version.VectorClock, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	siblings := d.store[key]
+	current := version.MergedClock(siblings)
+	if !cond.Holds(siblings) {
+		return current, version.ErrPreconditionFailed
+	}
+	return d.write(key, value, contentType, current), nil
+}
+
+// Delete removes key if cond holds. It reports whether the key existed.
+func (d *DHT) Delete(key string, cond version.Condition) (bool, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.store[key] = value
+	siblings, ok := d.store[key]
+	if !cond.Holds(siblings) {
+		return ok, version.ErrPreconditionFailed
+	}
+	if ok {
+		delete(d.store, key)
+		d.save()
+	}
+	return ok, nil
+}
+
+// write replaces all siblings of key with value. The caller must hold d.mu.
+func (d *DHT) write(key string, value []byte, contentType string, current version.VectorClock) version.VectorClock {
+	clock := current.Increment(d.NodeID)
+	d.store[key] = []version.Versioned{{Value: value, ContentType: contentType, Clock: clock}}
+	d.save()
+	return clock
+}
+
+// Merge applies a value replicated from another node. Values that are
+// causally newer replace what is stored, concurrent values are kept as siblings.
+func (d *DHT) Merge(key string, v version.Versioned) []version.Versioned {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.store[key] = version.Reconcile(d.store[key], v)
 	d.save()
+	return d.store[key]
 }
 
-func (d *DHT) Get(key string) ([]byte, bool) {
+// Get returns all siblings stored under key.
+func (d *DHT) Get(key string) ([]version.Versioned, bool) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 	v, ok := d.store[key]
 	return v, ok
 }
 
-func (d *DHT) save() {
-	tmp := make(map[string]string, len(d.store))
-	for k, v := range d.store {
-		tmp[k] = hex.EncodeToString(v)
+// Stats returns the number of keys and the total size of all stored values.
+func (d *DHT) Stats() (keys, bytes int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, siblings := range d.store {
+		for _, v := range siblings {
+			bytes += len(v.Value)
+		}
 	}
+	return len(d.store), bytes
+}
+
+func (d *DHT) save() {
 	f, err := os.Create(d.persistFile)
 	if err == nil {
 		defer f.Close()
 		enc := json.NewEncoder(f)
-		enc.Encode(tmp)
+		enc.Encode(d.store)
 	}
 }
 
@@ -61,11 +134,20 @@ func (d *DHT) load() {
 	if err == nil {
 		defer f.Close()
 		dec := json.NewDecoder(f)
-		var tmp map[string]string
+		var tmp map[string]json.RawMessage
 		if err := dec.Decode(&tmp); err == nil {
-			for k, v := range tmp {
-				if b, err := hex.DecodeString(v); err == nil {
-					d.store[k] = b
+			for k, raw := range tmp {
+				var siblings []version.Versioned
+				if err := json.Unmarshal(raw, &siblings); err == nil {
+					d.store[k] = siblings
+					continue
+				}
+				// Legacy format: hex-encoded value without a version
+				var v string
+				if err := json.Unmarshal(raw, &v); err == nil {
+					if b, err := hex.DecodeString(v); err == nil {
+						d.store[k] = []version.Versioned{{Value: b, Clock: version.VectorClock{}}}
+					}
 				}
 			}
 		}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"sort"
+	"strings"
+
+	"dht-version"
+)
+
+// KeyInfo describes a stored key. Meta is only filled in when requested.
+type KeyInfo struct {
+	Key  string   `json:"key"`
+	Meta *KeyMeta `json:"meta,omitempty"`
+}
+
+// KeyMeta holds size and version information about a stored key.
+type KeyMeta struct {
+	Size     int                 `json:"size"` // size of the largest sibling in bytes
+	Siblings int                 `json:"siblings"`
+	Version  version.VectorClock `json:"version"`
+}
+
+// Keys returns up to limit keys with the given prefix that sort after the
+// cursor, in lexicographic order. The returned cursor is the last key of the
+// page, or empty if there are no more keys. Because the cursor is a key and
+// not an offset, pages stay consistent while other writes are happening.
+func (d *DHT) Keys(prefix, cursor string, limit int, withMeta bool) ([]KeyInfo, string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	keys := make([]string, 0)
+	for k := range d.store {
+		if strings.HasPrefix(k, prefix) && k > cursor {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	result := make([]KeyInfo, 0, len(keys))
+	for _, k := range keys {
+		info := KeyInfo{Key: k}
+		if withMeta {
+			info.Meta = keyMeta(d.store[k])
+		}
+		result = append(result, info)
+	}
+	return result, next
+}
+
+func keyMeta(siblings []version.Versioned) *KeyMeta {
+	meta := &KeyMeta{Siblings: len(siblings), Version: version.MergedClock(siblings)}
+	for _, s := range siblings {
+		if len(s.Value) > meta.Size {
+			meta.Size = len(s.Value)
+		}
+	}
+	return meta
+}
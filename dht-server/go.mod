@@ -1,3 +1,15 @@
 module dht-server
 
 go 1.24.3
+
+require (
+	dht-logging v0.0.0
+	dht-metrics v0.0.0
+	dht-version v0.0.0
+)
+
+replace (
+	dht-logging => ../dht-logging
+	dht-metrics => ../dht-metrics
+	dht-version => ../dht-version
+)
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"dht-logging"
+	"dht-metrics"
 	"dht-server/dht"
 	"dht-server/name_mapper"
+	"dht-version"
 )
 
 /*
@@ -24,7 +33,9 @@ It supports storing and retrieving binary content by either a direct key or a hu
 
 Key Features:
 - Content is stored in a local persistent map (using the dht package).
-- Each server instance has a unique node ID derived from its address and port.
+- Each server instance has a node ID derived from its advertised address, which names it in
+  the vector clocks; cluster members listening on the same port on different hosts get
+  different IDs.
 - Clients can PUT content by specifying either a 'key' or a 'name'.
   - If 'name' is provided, a key is generated as SHA-1(name) and the mapping is stored using the name-mapper package.
   - The mapping from name to key is persisted and can be queried.
@@ -34,14 +45,87 @@ Key Features:
 
 HTTP Endpoints:
 - POST /put
-    Request JSON:  { "key": "...", "name": "...", "value": "<base64>" }
+    Request JSON:  { "key": "...", "name": "...", "value": "<base64>", "version": {...} }
       - Either 'key' or 'name' must be provided. If both are provided, 'name' takes precedence.
-    Response JSON: { "key": "..." } (the key used to store the value)
+      - 'version' is optional. If given, it must match the current version of the key
+        (as returned by /get), otherwise 409 Conflict is returned. An empty version ({})
+        means the key must not exist yet.
+      - 'condition' is optional and makes the put conditional (compare-and-swap):
+          { "if_hash": "<hex sha1 of current value>", "if_version": {...},
+            "if_absent": true, "if_present": true }
+        All given fields must hold, otherwise 412 Precondition Failed is returned.
+        'condition' and 'version' cannot be combined.
+    Response JSON: { "key": "...", "version": {...} } (the key used and the new version)
 
 - GET /get?key=... or /get?name=...
-    Response JSON: { "key": "...", "value": "<base64>", "found": true/false }
+    Response JSON: { "key": "...", "value": "<base64>", "content_type": "...", "version": {...}, "siblings": [...], "found": true/false }
       - If 'name' is provided, it is resolved to a key using the name-mapper.
+      - 'content_type' is the Content-Type a value was stored with through /v1/objects, if any.
       - If the key is not found, 'found' is false and 'value' is empty.
+      - If concurrent writes left conflicting values, 'value' is empty and all of them are
+        returned in 'siblings'. Writing back with 'version' resolves the conflict.
+
+- GET /keys?prefix=...&cursor=...&limit=...&meta=true
+    Response JSON: { "keys": [ { "key": "...", "meta": { "size": 3, "siblings": 1, "version": {...} } } ],
+                     "next_cursor": "..." }
+      - Keys are returned in lexicographic order, at most 'limit' per page (default 100, max 1000).
+      - Pass 'next_cursor' as 'cursor' to fetch the next page; it is empty on the last page.
+      - 'meta' is only included when meta=true.
+
+- POST /batch/put
+    Request JSON:  { "items": [ <same objects as /put>, ... ] }
+    Response:      NDJSON, one line per item in request order:
+                   { "key": "...", "version": {...}, "status": 200, "error": "..." }
+      - A failing item (bad request, 409, 412) is reported in its line and does not stop the batch.
+
+- POST /batch/get
+    Request JSON:  { "keys": ["...", ...], "names": ["...", ...] }
+    Response:      NDJSON, one /get response per line with an added "status" (and "name" if looked up by name)
+
+- PUT /v1/objects/{key}, POST /v1/objects
+    Request body:  raw bytes, with the Content-Type header stored alongside the value
+      - POST stores the body under its SHA-1 (content-addressed) and returns 201 with a Location header.
+      - If-Match: "<etag>" / If-Match: * / If-None-Match: * make the write conditional (412 if not met).
+    Response:      204 (PUT) or 201 (POST) with the ETag of the stored value
+
+- GET, HEAD /v1/objects/{key}
+    Response:      raw bytes with the stored Content-Type and ETag (SHA-1 of the content)
+      - Range requests and If-None-Match (304 Not Modified) are supported.
+      - 300 Multiple Choices with the /get JSON body if the key holds conflicting siblings.
+
+- DELETE /v1/objects/{key}
+    Response:      204, 404 if the key does not exist, 412 if If-Match does not hold
+
+- GET /metrics
+    Prometheus text format: requests by handler and status, request latency, store key/byte counts.
+
+- POST /replicate
+    Request JSON:  { "key": "...", "value": "<base64>", "clock": {...} }
+      - Merges a versioned value from another replica. Causally newer values replace the
+        stored one, concurrent values are kept as siblings.
+
+- GET /cluster?key=...   (cluster mode only)
+    Response JSON: { "self": "...", "members": [...], "vnodes": 64, "replicas": 2,
+                     "rebalancing": false, "key": "...", "owners": [...] }
+      - 'owners' lists the members holding 'key', primary first.
+
+Cluster mode (--cluster <file>):
+- The file lists the members: { "members": ["host:port", ...], "vnodes": 64, "replicas": 2 }.
+- Keys (SHA-1 of the key) and members (vnodes points each) are placed on a consistent-hash ring.
+  A key is owned by the first 'replicas' distinct members clockwise from it.
+- /put, /get, the batch endpoints and /v1/objects are served by an owner of the key; other
+  members forward them. An owner copies every write to the other owners through /replicate.
+  A read that finds no value at the first owner asks every member that may hold the key and
+  merges their siblings.
+- The file is reloaded when it changes or on SIGHUP. Each member then sends the keys it holds
+  to their new owners and deletes the ones it no longer owns. Keys held outside their
+  placement are handed off the same way every --cluster-sweep-interval.
+- A request is only taken as forwarded by a member if X-DHT-Forwarded names a current member and the request comes from that member's host.
+- /keys and /replicate only ever concern the local store.
+
+Versioning:
+- Every value carries a vector clock (node ID -> write counter), returned as 'version'.
+- A put increments this node's counter on top of the current version.
 
 Architecture:
 - The DHT logic (Put, Get, persistence) is in the dht package.
@@ -54,21 +138,45 @@ This code is intended for learning and experimentation with DHT concepts and sim
 // PutRequest represents the JSON body for /put
 // Either 'key' or 'name' must be provided. 'value' is base64-encoded.
 type PutRequest struct {
-	Key   string `json:"key,omitempty"`
-	Name  string `json:"name,omitempty"`
-	Value string `json:"value"` // base64 encoded
+	Key       string              `json:"key,omitempty"`
+	Name      string              `json:"name,omitempty"`
+	Value     string              `json:"value"`               // base64 encoded
+	Version   version.VectorClock `json:"version"`             // expected current version; {} means the key must not exist
+	Condition *version.Condition  `json:"condition,omitempty"` // conditional put
 }
 
-// PutResponse is returned by /put, always containing the key used
+// PutResponse is returned by /put, always containing the key used and its new version
 type PutResponse struct {
-	Key string `json:"key"`
+	Key     string              `json:"key"`
+	Version version.VectorClock `json:"version"`
 }
 
-// GetResponse is returned by /get, with the key, value (base64), and found flag
+// GetResponse is returned by /get, with the key, value (base64), content type, version and found flag.
+// Siblings is only set when the key holds conflicting values.
 type GetResponse struct {
-	Key   string `json:"key"`
-	Value string `json:"value"` // base64 encoded
-	Found bool   `json:"found"`
+	Key         string              `json:"key"`
+	Value       string              `json:"value"` // base64 encoded
+	ContentType string              `json:"content_type,omitempty"`
+	Version     version.VectorClock `json:"version,omitempty"`
+	Siblings    []version.Versioned `json:"siblings,omitempty"`
+	Found       bool                `json:"found"`
+}
+
+// KeysResponse is returned by /keys
+type KeysResponse struct {
+	Keys       []dht.KeyInfo `json:"keys"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+// ReplicateRequest represents the JSON body for /replicate
+type ReplicateRequest struct {
+	Key string `json:"key"`
+	version.Versioned
 }
 
 // keyFromName generates a key from a name using SHA-1 and hex encoding
@@ -78,7 +186,7 @@ func keyFromName(name string) string {
 }
 
 // putHandler handles POST /put requests
-func putHandler(dhtInst *dht.DHT, nm *name_mapper.NameMapper, nameMapFile string) http.HandlerFunc {
+func putHandler(dhtInst *dht.DHT, cluster *Cluster, nm *name_mapper.NameMapper, nameMapFile string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -94,38 +202,75 @@ func putHandler(dhtInst *dht.DHT, nm *name_mapper.NameMapper, nameMapFile string
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var key string
-		// If name is provided, generate key and store mapping
-		if req.Name != "" {
-			key = keyFromName(req.Name)
-			nm.Set(req.Name, key)
-			_ = nm.Save(nameMapFile)
-		} else if req.Key != "" {
-			key = req.Key
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("must provide 'key' or 'name'"))
+		resp, status, msg := applyPut(r.Context(), dhtInst, cluster, nm, nameMapFile, req)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			w.Write([]byte(msg))
 			return
 		}
-		val, err := base64.StdEncoding.DecodeString(req.Value)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		dhtInst.Put(key, val)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(PutResponse{Key: key})
+		json.NewEncoder(w).Encode(resp)
 	}
 }
 
+// applyPut validates and stores a single PutRequest, or forwards it to an
+// owner of the key in cluster mode. It returns the response, the HTTP status
+// to report, and an error message if the status is not 200.
+func applyPut(ctx context.Context, dhtInst *dht.DHT, cluster *Cluster, nm *name_mapper.NameMapper, nameMapFile string, req PutRequest) (PutResponse, int, string) {
+	var key string
+	// If name is provided, generate key and store mapping
+	if req.Name != "" {
+		key = keyFromName(req.Name)
+		nm.Set(req.Name, key)
+		_ = nm.Save(nameMapFile)
+	} else if req.Key != "" {
+		key = req.Key
+	} else {
+		return PutResponse{}, http.StatusBadRequest, "must provide 'key' or 'name'"
+	}
+	val, err := base64.StdEncoding.DecodeString(req.Value)
+	if err != nil {
+		return PutResponse{Key: key}, http.StatusBadRequest, "value must be base64"
+	}
+	if req.Condition != nil && req.Version != nil {
+		return PutResponse{Key: key}, http.StatusBadRequest, "'condition' and 'version' cannot be combined"
+	}
+	if req.Condition != nil && req.Condition.Empty() {
+		return PutResponse{Key: key}, http.StatusBadRequest, "'condition' sets no predicate"
+	}
+	if cluster != nil {
+		if owners, forward := cluster.route(ctx, key); forward {
+			return cluster.forwardPut(ctx, owners, key, req)
+		}
+	}
+	var clock version.VectorClock
+	if req.Condition != nil {
+		clock, err = dhtInst.PutIf(key, val, *req.Condition)
+	} else {
+		clock, err = dhtInst.Put(key, val, req.Version)
+	}
+	if errors.Is(err, dht.ErrConflict) {
+		logging.RequestLogger(ctx).Info("put rejected: version conflict", "key", key)
+		return PutResponse{Key: key}, http.StatusConflict, "version does not match current value"
+	}
+	if errors.Is(err, version.ErrPreconditionFailed) {
+		logging.RequestLogger(ctx).Info("put rejected: precondition failed", "key", key)
+		return PutResponse{Key: key}, http.StatusPreconditionFailed, "condition does not hold for current value"
+	}
+	if cluster != nil {
+		cluster.replicateWrite(ctx, key)
+	}
+	return PutResponse{Key: key, Version: clock}, http.StatusOK, ""
+}
+
 // getHandler handles GET /get requests
-func getHandler(dhtInst *dht.DHT, nm *name_mapper.NameMapper) http.HandlerFunc {
+func getHandler(dhtInst *dht.DHT, cluster *Cluster, nm *name_mapper.NameMapper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		name := r.URL.Query().Get("name")
 		// If name is provided, look up the key
 		if name != "" {
-			if k, ok := nm.Get(name); ok {
+			if k, ok := resolveName(cluster, nm, name); ok {
 				key = k
 			} else {
 				w.WriteHeader(http.StatusNotFound)
@@ -136,37 +281,195 @@ func getHandler(dhtInst *dht.DHT, nm *name_mapper.NameMapper) http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		val, ok := dhtInst.Get(key)
-		resp := GetResponse{Key: key, Found: ok}
-		if ok {
-			resp.Value = base64.StdEncoding.EncodeToString(val)
+		resp, err := lookup(r.Context(), dhtInst, cluster, key)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
+// resolveName returns the key stored for name. In cluster mode the mapping
+// may have been stored by another member, so an unknown name resolves to the
+// key a put would have used for it.
+func resolveName(cluster *Cluster, nm *name_mapper.NameMapper, name string) (string, bool) {
+	if k, ok := nm.Get(name); ok {
+		return k, true
+	}
+	if cluster != nil {
+		return keyFromName(name), true
+	}
+	return "", false
+}
+
+// lookup reads key from the local store, or from an owner of the key in
+// cluster mode. If the owner asked first does not have the key, every
+// member that may hold it is asked and their siblings are merged. A request
+// forwarded by another member is answered from the local store.
+func lookup(ctx context.Context, dhtInst *dht.DHT, cluster *Cluster, key string) (GetResponse, error) {
+	if cluster == nil {
+		siblings, ok := dhtInst.Get(key)
+		return newGetResponse(key, siblings, ok), nil
+	}
+	if owners, forward := cluster.route(ctx, key); forward {
+		if resp, err := cluster.forwardGet(ctx, owners, key); err == nil && resp.Found {
+			return resp, nil
+		}
+	} else if siblings, ok := dhtInst.Get(key); ok || forwardedBy(ctx) != "" {
+		return newGetResponse(key, siblings, ok), nil
+	}
+	return cluster.gather(ctx, key)
+}
+
+// newGetResponse builds a GetResponse from the siblings stored under key
+func newGetResponse(key string, siblings []version.Versioned, found bool) GetResponse {
+	resp := GetResponse{Key: key, Found: found}
+	if !found {
+		return resp
+	}
+	resp.Version = version.MergedClock(siblings)
+	if len(siblings) == 1 {
+		resp.Value = base64.StdEncoding.EncodeToString(siblings[0].Value)
+		resp.ContentType = siblings[0].ContentType
+	} else {
+		resp.Siblings = siblings
+	}
+	return resp
+}
+
+// registerStoreMetrics exposes the store size on /metrics
+func registerStoreMetrics(dhtInst *dht.DHT) {
+	metrics.NewGaugeFunc("dht_store_keys", "Number of keys in the local store.", func() float64 {
+		keys, _ := dhtInst.Stats()
+		return float64(keys)
+	})
+	metrics.NewGaugeFunc("dht_store_bytes", "Total size of values in the local store.", func() float64 {
+		_, size := dhtInst.Stats()
+		return float64(size)
+	})
+}
+
+// keysHandler handles GET /keys requests
+func keysHandler(dhtInst *dht.DHT) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := defaultKeysLimit
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxKeysLimit)
+		}
+		withMeta := q.Get("meta") == "true"
+		keys, next := dhtInst.Keys(q.Get("prefix"), q.Get("cursor"), limit, withMeta)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(KeysResponse{Keys: keys, NextCursor: next})
+	}
+}
+
+// replicateHandler handles POST /replicate requests from other replicas
+func replicateHandler(dhtInst *dht.DHT) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req ReplicateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		siblings := dhtInst.Merge(req.Key, req.Versioned)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newGetResponse(req.Key, siblings, true))
+	}
+}
+
 func main() {
+	// Command-line flags
+	var logLevel, logFormat, clusterFile, advertiseAddr string
+	var clusterReload, clusterSweep, clusterTimeout time.Duration
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format (text, json)")
+	flag.StringVar(&clusterFile, "cluster", "", "Cluster file listing the members (JSON); enables cluster mode")
+	flag.StringVar(&advertiseAddr, "advertise-addr", "", "This server's address in the cluster member list (default: the listen address, with 127.0.0.1 for an empty host)")
+	flag.DurationVar(&clusterReload, "cluster-reload-interval", defaultClusterReload, "How often to check the cluster file for changes")
+	flag.DurationVar(&clusterSweep, "cluster-sweep-interval", defaultClusterSweep, "How often to hand off keys held outside their placement")
+	flag.DurationVar(&clusterTimeout, "cluster-timeout", defaultClusterTimeout, "Timeout of each call to another cluster member")
+	flag.Parse()
+	if err := logging.Setup(logLevel, logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if clusterReload <= 0 || clusterSweep <= 0 || clusterTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "--cluster-reload-interval, --cluster-sweep-interval and --cluster-timeout must be positive")
+		os.Exit(2)
+	}
+
 	// Server address (default :8080, can override with first arg)
 	addr := ":8080"
-	if len(os.Args) > 1 {
-		addr = os.Args[1]
+	if flag.NArg() > 0 {
+		addr = flag.Arg(0)
+	}
+	if advertiseAddr == "" {
+		advertiseAddr = addr
+		if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+			advertiseAddr = net.JoinHostPort("127.0.0.1", port)
+		}
 	}
 	// File paths for DHT and name mapping persistence
 	persistFile := filepath.Join(".", "store.json")
 	nameMapFile := filepath.Join(".", "namemap.json")
 
-	// Initialize DHT and NameMapper, loading persisted data if available
-	dhtInst := dht.NewDHT(addr, persistFile)
+	// Initialize DHT and NameMapper, loading persisted data if available. The
+	// node ID names this server in vector clocks, so it comes from the address
+	// other members know it by rather than the listen address.
+	dhtInst := dht.NewDHT(advertiseAddr, persistFile)
 	nm := name_mapper.NewNameMapper()
 	_ = nm.Load(nameMapFile)
 
 	fmt.Printf("Node ID: %s\n", dhtInst.NodeID)
+	registerStoreMetrics(dhtInst)
+
+	// Cluster mode: route keys to their owners on the consistent-hash ring
+	var cluster *Cluster
+	if clusterFile != "" {
+		var err error
+		if cluster, err = newCluster(clusterFile, advertiseAddr, dhtInst, clusterTimeout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		slog.Info("cluster mode", "self", advertiseAddr, "members", cluster.config.Members, "vnodes", cluster.config.Vnodes, "replicas", cluster.config.Replicas)
+		go cluster.Run(context.Background(), clusterReload, clusterSweep)
+	}
 
-	// Register HTTP handlers
-	http.HandleFunc("/put", putHandler(dhtInst, nm, nameMapFile))
-	http.HandleFunc("/get", getHandler(dhtInst, nm))
+	// Register HTTP handlers with request IDs, logging and metrics
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.HandleFunc(pattern, metrics.InstrumentHandler(pattern, logging.LogRequest(pattern, markForwarded(cluster, h))))
+	}
+	handle("/put", putHandler(dhtInst, cluster, nm, nameMapFile))
+	handle("/get", getHandler(dhtInst, cluster, nm))
+	handle("/batch/put", batchPutHandler(dhtInst, cluster, nm, nameMapFile))
+	handle("/batch/get", batchGetHandler(dhtInst, cluster, nm))
+	handle("/keys", keysHandler(dhtInst))
+	handle("GET /v1/objects/{key}", objectGetHandler(dhtInst, cluster))
+	handle("PUT /v1/objects/{key}", objectPutHandler(dhtInst, cluster))
+	handle("POST /v1/objects", objectPostHandler(dhtInst, cluster))
+	handle("DELETE /v1/objects/{key}", objectDeleteHandler(dhtInst, cluster))
+	handle("/replicate", replicateHandler(dhtInst))
+	if cluster != nil {
+		handle("/cluster", clusterHandler(cluster))
+	}
+	http.HandleFunc("/metrics", metrics.Handler())
 
-	log.Printf("Listening on %s...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	slog.Info("listening", "addr", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dht-server/dht"
+	"dht-version"
+)
+
+// maxObjectSize bounds the body of an object write.
+const maxObjectSize = 64 << 20
+
+// objectCondition turns the If-Match / If-None-Match request headers of a
+// write into a version.Condition. ETags are the hex SHA-1 of the content.
+func objectCondition(r *http.Request) version.Condition {
+	var cond version.Condition
+	if m := r.Header.Values("If-Match"); len(m) > 0 {
+		tags, any := parseETags(strings.Join(m, ","))
+		if any {
+			cond.IfPresent = true
+		} else {
+			cond.IfHashIn = tags
+		}
+	}
+	if _, any := parseETags(strings.Join(r.Header.Values("If-None-Match"), ",")); any {
+		cond.IfAbsent = true
+	}
+	return cond
+}
+
+// parseETags parses an If-Match or If-None-Match header: "*" or a
+// comma-separated list of entity tags. It returns the opaque values of the
+// strong tags and whether the header is "*". Weak tags (W/"...") are left
+// out, as they never match under the strong comparison If-Match uses.
+func parseETags(h string) (strong []string, any bool) {
+	strong = []string{}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "*":
+			any = true
+		case len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"':
+			strong = append(strong, t[1:len(t)-1])
+		}
+	}
+	return strong, any
+}
+
+// etag returns the strong ETag of a value with the given hash: the quoted
+// hash. For content-addressed keys this is the key itself.
+func etag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// readObject reads the body of an object write, up to maxObjectSize, hashing
+// it while it is copied. On error it writes 413 or 400 and reports false.
+func readObject(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	var buf bytes.Buffer
+	h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, h), http.MaxBytesReader(w, r.Body, maxObjectSize)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return nil, "", false
+	}
+	return buf.Bytes(), hex.EncodeToString(h.Sum(nil)), true
+}
+
+// objectGetHandler handles GET and HEAD /v1/objects/{key}. The raw value is
+// served with its stored Content-Type; Range and If-None-Match are supported.
+func objectGetHandler(dhtInst *dht.DHT, cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if cluster != nil {
+			if owners, forward := cluster.route(r.Context(), key); forward {
+				cluster.proxy(w, r, owners, nil)
+				return
+			}
+		}
+		siblings, ok := dhtInst.Get(key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(siblings) > 1 {
+			// Conflicting values cannot be served as one object
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultipleChoices)
+			json.NewEncoder(w).Encode(newGetResponse(key, siblings, true))
+			return
+		}
+		v := siblings[0]
+		ct := v.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("ETag", etag(version.HashValue(v.Value)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(v.Value))
+	}
+}
+
+// objectPutHandler handles PUT /v1/objects/{key}. The request body is stored
+// as is, together with its Content-Type.
+func objectPutHandler(dhtInst *dht.DHT, cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		storeObject(w, r, dhtInst, cluster, key)
+	}
+}
+
+// objectPostHandler handles POST /v1/objects, storing the body under its
+// content hash and returning the new location.
+func objectPostHandler(dhtInst *dht.DHT, cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storeObject(w, r, dhtInst, cluster, "")
+	}
+}
+
+// storeObject stores the request body under key, or under its SHA-1 if key is
+// empty. In cluster mode the request is passed on if the key belongs to other
+// members.
+func storeObject(w http.ResponseWriter, r *http.Request, dhtInst *dht.DHT, cluster *Cluster, key string) {
+	body, hash, ok := readObject(w, r)
+	if !ok {
+		return
+	}
+	status := http.StatusNoContent
+	if key == "" {
+		key = hash
+		status = http.StatusCreated
+	}
+	if cluster != nil {
+		if owners, forward := cluster.route(r.Context(), key); forward {
+			cluster.proxy(w, r, owners, body)
+			return
+		}
+	}
+	_, err := dhtInst.PutObject(key, body, r.Header.Get("Content-Type"), objectCondition(r))
+	if errors.Is(err, version.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if cluster != nil {
+		cluster.replicateWrite(r.Context(), key)
+	}
+	w.Header().Set("ETag", etag(hash))
+	if status == http.StatusCreated {
+		w.Header().Set("Location", fmt.Sprintf("/v1/objects/%s", key))
+	}
+	w.WriteHeader(status)
+}
+
+// objectDeleteHandler handles DELETE /v1/objects/{key}
+func objectDeleteHandler(dhtInst *dht.DHT, cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if cluster != nil {
+			if owners, forward := cluster.route(r.Context(), key); forward {
+				cluster.proxy(w, r, owners, nil)
+				return
+			}
+		}
+		existed, err := dhtInst.Delete(key, objectCondition(r))
+		if errors.Is(err, version.ErrPreconditionFailed) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if !existed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if cluster != nil {
+			cluster.replicateDelete(r.Context(), key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
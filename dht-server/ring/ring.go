@@ -0,0 +1,76 @@
+// Package ring implements a consistent-hash ring with virtual nodes.
+package ring
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/binary"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Ring places members and keys on a 64-bit hash ring. Each member appears at
+// several points (virtual nodes), which evens out the share of keys each one
+// owns and spreads the keys of a removed member over all the others.
+type Ring struct {
+	members []string
+	points  []point // sorted by hash
+}
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+// Hash returns the position of s on the ring: the first 64 bits of its SHA-1.
+func Hash(s string) uint64 {
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// New returns a ring holding vnodes points for each member. Duplicate
+// members are ignored.
+func New(members []string, vnodes int) *Ring {
+	r := &Ring{}
+	for _, m := range members {
+		if slices.Contains(r.members, m) {
+			continue
+		}
+		r.members = append(r.members, m)
+		for i := range vnodes {
+			r.points = append(r.points, point{hash: Hash(m + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	// Ties are broken by name so every server builds the same ring
+	slices.SortFunc(r.points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.member, b.member))
+	})
+	return r
+}
+
+// Members returns the members of the ring in the order they were given.
+func (r *Ring) Members() []string {
+	return slices.Clone(r.members)
+}
+
+// Owners returns the n distinct members responsible for key: the member of
+// the first point clockwise from the key's hash, followed by the next
+// distinct members around the ring. Fewer are returned if the ring has fewer
+// than n members.
+func (r *Ring) Owners(key string, n int) []string {
+	n = min(n, len(r.members))
+	if n <= 0 || len(r.points) == 0 {
+		return nil
+	}
+	h := Hash(key)
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int { return cmp.Compare(p.hash, h) })
+	owners := make([]string, 0, n)
+	for i := 0; len(owners) < n; i++ {
+		m := r.points[(start+i)%len(r.points)].member
+		if !slices.Contains(owners, m) {
+			owners = append(owners, m)
+		}
+	}
+	return owners
+}
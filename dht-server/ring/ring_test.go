@@ -0,0 +1,132 @@
+package ring
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestOwnersDistinct(t *testing.T) {
+	members := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+	r := New(members, 16)
+	for _, key := range testKeys(1000) {
+		owners := r.Owners(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("Owners(%s, 3) = %v, want 3 members", key, owners)
+		}
+		for i, m := range owners {
+			if !slices.Contains(members, m) || slices.Contains(owners[:i], m) {
+				t.Fatalf("Owners(%s, 3) = %v, want distinct members", key, owners)
+			}
+		}
+		// Fewer owners are a prefix of more
+		if primary := r.Owners(key, 1); !slices.Equal(primary, owners[:1]) {
+			t.Fatalf("Owners(%s, 1) = %v, want %v", key, primary, owners[:1])
+		}
+	}
+}
+
+func TestOwnersWrapAround(t *testing.T) {
+	r := New([]string{"a:1", "b:1", "c:1"}, 1)
+	last := r.points[len(r.points)-1].hash
+	var wrapped []string
+	for _, key := range testKeys(100) {
+		if Hash(key) > last {
+			wrapped = append(wrapped, key)
+		}
+	}
+	if len(wrapped) == 0 {
+		t.Fatal("no test key hashes past the last point")
+	}
+	// A key past the last point belongs to the first points of the ring
+	want := []string{r.points[0].member, r.points[1].member, r.points[2].member}
+	for _, key := range wrapped {
+		if owners := r.Owners(key, 3); !slices.Equal(owners, want) {
+			t.Errorf("Owners(%s, 3) = %v, want %v", key, owners, want)
+		}
+	}
+}
+
+func TestOwnersMoreThanMembers(t *testing.T) {
+	members := []string{"a:1", "b:1", "c:1"}
+	r := New(members, 8)
+	for _, key := range testKeys(100) {
+		owners := r.Owners(key, 5)
+		if len(owners) != len(members) {
+			t.Fatalf("Owners(%s, 5) = %v, want all %d members", key, owners, len(members))
+		}
+		for _, m := range members {
+			if !slices.Contains(owners, m) {
+				t.Fatalf("Owners(%s, 5) = %v, missing %s", key, owners, m)
+			}
+		}
+	}
+	if owners := r.Owners("key", 0); owners != nil {
+		t.Errorf("Owners(key, 0) = %v, want none", owners)
+	}
+	if owners := New(nil, 8).Owners("key", 2); owners != nil {
+		t.Errorf("empty ring: Owners(key, 2) = %v, want none", owners)
+	}
+}
+
+func TestNewIgnoresOrderAndDuplicates(t *testing.T) {
+	a := New([]string{"a:1", "b:1", "c:1"}, 16)
+	b := New([]string{"c:1", "a:1", "b:1", "a:1"}, 16)
+	if got := b.Members(); !slices.Equal(got, []string{"c:1", "a:1", "b:1"}) {
+		t.Errorf("Members() = %v, want duplicates dropped", got)
+	}
+	for _, key := range testKeys(200) {
+		if x, y := a.Owners(key, 2), b.Owners(key, 2); !slices.Equal(x, y) {
+			t.Fatalf("Owners(%s, 2) = %v and %v for the same members", key, x, y)
+		}
+	}
+}
+
+func TestOwnersOnAdd(t *testing.T) {
+	before := New([]string{"a:1", "b:1", "c:1", "d:1"}, 64)
+	after := New([]string{"a:1", "b:1", "c:1", "d:1", "e:1"}, 64)
+	keys := testKeys(5000)
+	moved := 0
+	for _, key := range keys {
+		oldOwners, newOwners := before.Owners(key, 2), after.Owners(key, 2)
+		// Only the new member gains keys
+		for _, m := range newOwners {
+			if m != "e:1" && !slices.Contains(oldOwners, m) {
+				t.Fatalf("key %s moved from %v to %v, not to the new member", key, oldOwners, newOwners)
+			}
+		}
+		if before.Owners(key, 1)[0] != after.Owners(key, 1)[0] {
+			moved++
+		}
+	}
+	// About a fifth of the primaries move to the new member
+	if share := float64(moved) / float64(len(keys)); share < 0.1 || share > 0.3 {
+		t.Errorf("%.2f of the keys changed primary, want about 0.2", share)
+	}
+}
+
+func TestOwnersOnRemove(t *testing.T) {
+	before := New([]string{"a:1", "b:1", "c:1", "d:1"}, 64)
+	after := New([]string{"a:1", "b:1", "d:1"}, 64)
+	for _, key := range testKeys(5000) {
+		oldOwners, newOwners := before.Owners(key, 2), after.Owners(key, 2)
+		// Every remaining owner keeps the key; only the removed member's
+		// place is taken, by the next member on the ring
+		for _, m := range oldOwners {
+			if m != "c:1" && !slices.Contains(newOwners, m) {
+				t.Fatalf("key %s moved from %v to %v, though %s is still a member", key, oldOwners, newOwners, m)
+			}
+		}
+		if !slices.Contains(oldOwners, "c:1") && !slices.Equal(oldOwners, newOwners) {
+			t.Fatalf("key %s not owned by the removed member moved from %v to %v", key, oldOwners, newOwners)
+		}
+	}
+}
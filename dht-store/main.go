@@ -5,9 +5,12 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 )
 
 var (
@@ -124,10 +127,50 @@ func get(keyOrName string) {
 	}
 }
 
+// list prints stored keys with the given prefix in lexicographic order, one
+// page at a time. The cursor is the last key of the previous page.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "maximum number of keys to print")
+	cursor := fs.String("cursor", "", "print keys after this key (from a previous page)")
+	long := fs.Bool("l", false, "include value sizes and names")
+	fs.Parse(args)
+	prefix := fs.Arg(0)
+
+	names := make(map[string][]string)
+	for n, k := range nameMap {
+		names[k] = append(names[k], n)
+	}
+	keys := make([]string, 0)
+	for k := range store {
+		if strings.HasPrefix(k, prefix) && k > *cursor {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	next := ""
+	if *limit > 0 && len(keys) > *limit {
+		keys = keys[:*limit]
+		next = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		if *long {
+			sort.Strings(names[k])
+			fmt.Printf("%s\t%d\t%s\n", k, len(store[k]), strings.Join(names[k], ","))
+		} else {
+			fmt.Println(k)
+		}
+	}
+	if next != "" {
+		fmt.Printf("Next cursor: %s\n", next)
+	}
+}
+
 func usage() {
 	fmt.Println("Usage:")
 	fmt.Println("  put <name> [file]")
 	fmt.Println("  get <key|name>")
+	fmt.Println("  list [-l] [-limit N] [-cursor KEY] [prefix]")
 	os.Exit(1)
 }
 
@@ -154,6 +197,8 @@ func main() {
 		} else {
 			usage()
 		}
+	case "list":
+		list(os.Args[2:])
 	default:
 		usage()
 	}
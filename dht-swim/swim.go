@@ -0,0 +1,476 @@
+// Package swim is a SWIM-style failure detector over the peers in a routing
+// table. It is shared by dht-node and dht-network, which serve its handlers
+// at /swim/ping and /swim/ping-req.
+package swim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"dht-logging"
+	"dht-metrics"
+)
+
+// Defaults for the probe interval given to Run and the options of New.
+const (
+	DefaultInterval       = time.Second
+	DefaultPingTimeout    = 500 * time.Millisecond
+	DefaultIndirect       = 3
+	DefaultSuspectTimeout = 5 * time.Second
+
+	// deadMemberRetention is how long a dead member is remembered after it
+	// was evicted, so that old gossip about it is recognised as old.
+	deadMemberRetention = 5 * time.Minute
+	// maxPiggyback bounds the membership updates carried by one message.
+	maxPiggyback = 8
+	// An update is piggybacked on retransmitMult * log2(cluster size + 1)
+	// messages, enough to reach every member with high probability.
+	retransmitMult = 3
+	maxMessageSize = 64 << 10
+)
+
+// Member states, as gossiped in membership updates.
+const (
+	memberAlive   = "alive"
+	memberSuspect = "suspect"
+	memberDead    = "dead"
+)
+
+// ErrProbeTimeout is the context cause of a probe that got no answer in
+// time, so a Client can tell it from a caller that gave up.
+var ErrProbeTimeout = errors.New("swim probe timeout")
+
+var members = metrics.NewGauge("dht_swim_members",
+	"Members known to the failure detector, by state.", "state")
+
+// Peer is a member as the routing table knows it.
+type Peer struct {
+	NodeID  string `json:"node_id"`
+	Address string `json:"address"` // host:port
+}
+
+// Table is the routing table the members are taken from.
+type Table interface {
+	// Members returns every peer in the table except this node.
+	Members() []Peer
+	// Lookup returns the peer with nodeID, if it is in the table.
+	Lookup(nodeID string) (Peer, bool)
+	// Evict removes a member confirmed dead.
+	Evict(nodeID string)
+	// Seen records that the member with nodeID was just heard from directly.
+	Seen(nodeID string)
+}
+
+// Client sends probes to members. It should let probes through to a member
+// that looks unreachable, so that a member that is back is noticed.
+type Client interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// MemberUpdate is a membership update piggybacked on SWIM messages. The
+// incarnation is raised only by the member itself, to refute a suspicion.
+type MemberUpdate struct {
+	NodeID      string `json:"node_id"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// Message is the body of /swim/ping and /swim/ping-req requests and of
+// their responses.
+type Message struct {
+	From    string         `json:"from"`
+	Target  *Peer          `json:"target,omitempty"` // ping-req: the member to probe
+	Ack     bool           `json:"ack,omitempty"`    // ping-req response: the target answered
+	Updates []MemberUpdate `json:"updates,omitempty"`
+}
+
+type member struct {
+	state       string
+	incarnation uint64
+	since       time.Time // when the member entered its state
+	unrefuted   bool      // back in the table, but has not refuted its death yet
+}
+
+type broadcast struct {
+	update    MemberUpdate
+	transmits int
+}
+
+// Membership is a SWIM-style failure detector over the peers in the routing
+// table. Every interval it probes one member, in random round-robin order:
+// first directly, then through up to indirect other members. A member that
+// answers neither is suspected, and confirmed dead if it does not refute the
+// suspicion within suspectTimeout. Dead members are evicted from the routing
+// table. State changes are spread by piggybacking them on probes and acks.
+type Membership struct {
+	selfID         string
+	table          Table
+	client         Client
+	pingTimeout    time.Duration
+	indirect       int
+	suspectTimeout time.Duration
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*member    // key: NodeID
+	queue       map[string]*broadcast // latest update per node ID, until sent often enough
+	probeOrder  []string
+}
+
+// New returns the failure detector of the node with selfID over table,
+// probing through client.
+func New(selfID string, table Table, client Client, pingTimeout time.Duration, indirect int, suspectTimeout time.Duration) *Membership {
+	return &Membership{
+		selfID:         selfID,
+		table:          table,
+		client:         client,
+		pingTimeout:    pingTimeout,
+		indirect:       indirect,
+		suspectTimeout: suspectTimeout,
+		members:        make(map[string]*member),
+		queue:          make(map[string]*broadcast),
+	}
+}
+
+// Run probes a member every interval until ctx is done.
+func (m *Membership) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.expireSuspects()
+		if target, ok := m.nextTarget(); ok {
+			m.probe(ctx, target)
+		}
+		for state, n := range m.Counts() {
+			members.Set(float64(n), state)
+		}
+	}
+}
+
+// syncLocked brings the members in line with the routing table: new peers
+// join as alive, peers no longer in the table are forgotten, and a dead
+// member that is back in the table (it answered a ping or contacted this
+// node) is probed again. It is re-admitted at the incarnation it died with,
+// and nothing is gossiped: only the member raises its incarnation, and its
+// own alive update, sent to refute its death, wins over the death news.
+func (m *Membership) syncLocked() {
+	inTable := make(map[string]bool)
+	for _, p := range m.table.Members() {
+		inTable[p.NodeID] = true
+		switch mem := m.members[p.NodeID]; {
+		case mem == nil:
+			m.members[p.NodeID] = &member{state: memberAlive, since: time.Now()}
+		case mem.state == memberDead:
+			slog.Info("dead member is back", "component", "swim", "peer_id", p.NodeID, "incarnation", mem.incarnation)
+			mem.state, mem.since, mem.unrefuted = memberAlive, time.Now(), true
+		}
+	}
+	for id, mem := range m.members {
+		if mem.state == memberDead && time.Since(mem.since) >= deadMemberRetention || mem.state != memberDead && !inTable[id] {
+			delete(m.members, id)
+		}
+	}
+}
+
+// nextTarget returns the next member to probe. Members are probed in a
+// random order that is reshuffled after each full round.
+func (m *Membership) nextTarget() (Peer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncLocked()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(m.probeOrder) > 0 {
+			id := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if mem, ok := m.members[id]; ok && mem.state != memberDead {
+				if p, ok := m.table.Lookup(id); ok {
+					return p, true
+				}
+			}
+		}
+		for id, mem := range m.members {
+			if mem.state != memberDead {
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(m.probeOrder), func(a, b int) {
+			m.probeOrder[a], m.probeOrder[b] = m.probeOrder[b], m.probeOrder[a]
+		})
+	}
+	return Peer{}, false
+}
+
+// probe pings target directly, then through other members, and suspects it
+// if neither gets an answer.
+func (m *Membership) probe(ctx context.Context, target Peer) {
+	if m.ping(ctx, target) || m.pingIndirect(ctx, target) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mem, ok := m.members[target.NodeID]; ok && mem.state == memberAlive {
+		slog.Warn("member not answering, suspected", "component", "swim", "peer_id", target.NodeID, "peer_addr", target.Address)
+		m.setStateLocked(target.NodeID, mem, memberSuspect, mem.incarnation)
+	}
+}
+
+// ping sends a direct probe to target and applies the updates in its ack.
+func (m *Membership) ping(ctx context.Context, target Peer) bool {
+	ctx, cancel := context.WithTimeoutCause(ctx, m.pingTimeout, ErrProbeTimeout)
+	defer cancel()
+	reply, err := m.send(ctx, target.Address, "/swim/ping", Message{From: m.selfID, Updates: m.updates(target.NodeID)})
+	if err != nil {
+		return false
+	}
+	m.apply(reply.Updates)
+	m.table.Seen(target.NodeID)
+	return true
+}
+
+// pingIndirect asks up to indirect random alive members to probe target,
+// and reports whether any of them got an answer.
+func (m *Membership) pingIndirect(ctx context.Context, target Peer) bool {
+	var helpers []Peer
+	m.mu.Lock()
+	for id, mem := range m.members {
+		if mem.state == memberAlive && id != target.NodeID {
+			if p, ok := m.table.Lookup(id); ok {
+				helpers = append(helpers, p)
+			}
+		}
+	}
+	m.mu.Unlock()
+	rand.Shuffle(len(helpers), func(a, b int) { helpers[a], helpers[b] = helpers[b], helpers[a] })
+	helpers = helpers[:min(len(helpers), m.indirect)]
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// A helper needs pingTimeout for its own probe, plus the round trip
+	ctx, cancel := context.WithTimeoutCause(ctx, 2*m.pingTimeout, ErrProbeTimeout)
+	defer cancel()
+	acks := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func() {
+			reply, err := m.send(ctx, h.Address, "/swim/ping-req", Message{From: m.selfID, Target: &target, Updates: m.updates(h.NodeID)})
+			if err == nil {
+				m.apply(reply.Updates)
+			}
+			acks <- err == nil && reply.Ack
+		}()
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Membership) send(ctx context.Context, addr, path string, msg Message) (Message, error) {
+	buf, _ := json.Marshal(msg)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s%s", addr, path), bytes.NewReader(buf))
+	if err != nil {
+		return Message{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	logging.SetRequestID(ctx, req)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return Message{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Message{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var reply Message
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxMessageSize)).Decode(&reply)
+	return reply, err
+}
+
+// expireSuspects confirms as dead every member suspected for longer than
+// suspectTimeout.
+func (m *Membership) expireSuspects() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, mem := range m.members {
+		if mem.state == memberSuspect && time.Since(mem.since) >= m.suspectTimeout {
+			m.setStateLocked(id, mem, memberDead, mem.incarnation)
+		}
+	}
+}
+
+// apply merges membership updates received from a peer. An update wins over
+// what this node knows if it has a higher incarnation, or the same
+// incarnation and a worse state. Updates about nodes not in the routing
+// table are ignored; a suspicion about this node itself is refuted.
+func (m *Membership) apply(updates []MemberUpdate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range updates[:min(len(updates), maxPiggyback)] {
+		if u.NodeID == m.selfID {
+			if u.State != memberAlive && u.Incarnation >= m.incarnation {
+				m.incarnation = u.Incarnation + 1
+				slog.Info("refuting membership update about this node", "component", "swim", "state", u.State, "incarnation", m.incarnation)
+				m.queue[m.selfID] = &broadcast{update: MemberUpdate{NodeID: m.selfID, State: memberAlive, Incarnation: m.incarnation}}
+			}
+			continue
+		}
+		mem, ok := m.members[u.NodeID]
+		if !ok {
+			continue
+		}
+		var wins bool
+		switch u.State {
+		case memberAlive:
+			wins = u.Incarnation > mem.incarnation
+		case memberSuspect:
+			wins = mem.state == memberAlive && u.Incarnation >= mem.incarnation ||
+				mem.state == memberSuspect && u.Incarnation > mem.incarnation
+		case memberDead:
+			// The death of a member that came back is old news at its incarnation
+			wins = mem.state != memberDead && (u.Incarnation > mem.incarnation || u.Incarnation == mem.incarnation && !mem.unrefuted)
+		}
+		if wins {
+			m.setStateLocked(u.NodeID, mem, u.State, u.Incarnation)
+		}
+	}
+}
+
+// setStateLocked records a state change, queues it for gossip, and evicts a
+// dead member from the routing table.
+func (m *Membership) setStateLocked(nodeID string, mem *member, state string, incarnation uint64) {
+	if mem.state != state {
+		mem.since = time.Now()
+		slog.Info("member state changed", "component", "swim", "peer_id", nodeID, "from", mem.state, "to", state, "incarnation", incarnation)
+	}
+	mem.state, mem.incarnation, mem.unrefuted = state, incarnation, false
+	m.queue[nodeID] = &broadcast{update: MemberUpdate{NodeID: nodeID, State: state, Incarnation: incarnation}}
+	if state == memberDead {
+		slog.Warn("member confirmed dead, evicted from routing table", "component", "swim", "peer_id", nodeID)
+		m.table.Evict(nodeID)
+	}
+}
+
+// updates returns the updates to piggyback on a message to recipient: what
+// this node holds against the recipient, so that it can refute it, then the
+// queued updates sent least often so far.
+func (m *Membership) updates(recipient string) []MemberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []MemberUpdate
+	mem, held := m.members[recipient]
+	switch {
+	case held && mem.unrefuted:
+		result = append(result, MemberUpdate{NodeID: recipient, State: memberDead, Incarnation: mem.incarnation})
+	case held && mem.state != memberAlive:
+		result = append(result, MemberUpdate{NodeID: recipient, State: mem.state, Incarnation: mem.incarnation})
+	default:
+		held = false
+	}
+	queued := make([]string, 0, len(m.queue))
+	for id := range m.queue {
+		queued = append(queued, id)
+	}
+	sort.Slice(queued, func(i, j int) bool { return m.queue[queued[i]].transmits < m.queue[queued[j]].transmits })
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	for _, id := range queued {
+		if len(result) == maxPiggyback {
+			break
+		}
+		if held && id == recipient {
+			continue
+		}
+		b := m.queue[id]
+		result = append(result, b.update)
+		if b.transmits++; b.transmits >= limit {
+			delete(m.queue, id)
+		}
+	}
+	return result
+}
+
+// State returns the state and incarnation of the member with nodeID.
+func (m *Membership) State(nodeID string) (string, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mem, ok := m.members[nodeID]; ok {
+		return mem.state, mem.incarnation
+	}
+	return "", 0
+}
+
+// Counts returns the number of members in each state.
+func (m *Membership) Counts() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int{memberAlive: 0, memberSuspect: 0, memberDead: 0}
+	for _, mem := range m.members {
+		counts[mem.state]++
+	}
+	return counts
+}
+
+func decodeMessage(w http.ResponseWriter, r *http.Request) (Message, bool) {
+	var msg Message
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return msg, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&msg); err != nil || msg.From == "" {
+		logging.RequestLogger(r.Context()).Warn("swim decode error", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return msg, false
+	}
+	return msg, true
+}
+
+// PingHandler acknowledges a direct probe, exchanging membership updates.
+func PingHandler(m *Membership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := decodeMessage(w, r)
+		if !ok {
+			return
+		}
+		m.apply(msg.Updates)
+		m.table.Seen(msg.From)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Message{From: m.selfID, Updates: m.updates(msg.From)})
+	}
+}
+
+// PingReqHandler probes the target on behalf of the sender and reports
+// whether it answered.
+func PingReqHandler(m *Membership) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := decodeMessage(w, r)
+		if !ok {
+			return
+		}
+		if msg.Target == nil || msg.Target.NodeID == "" || msg.Target.Address == "" || msg.Target.NodeID == m.selfID {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.apply(msg.Updates)
+		m.table.Seen(msg.From)
+		ack := m.ping(r.Context(), *msg.Target)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Message{From: m.selfID, Ack: ack, Updates: m.updates(msg.From)})
+	}
+}
@@ -0,0 +1,60 @@
+package version
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"slices"
+)
+
+// ErrPreconditionFailed is returned by a store's PutIf when the condition does not hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition describes what the current value must look like for a
+// conditional put to be applied. All set fields must hold.
+type Condition struct {
+	IfHash    string      `json:"if_hash,omitempty"`    // hex SHA-1 of the current value
+	IfVersion VectorClock `json:"if_version"`           // current version; {} when the key must not exist
+	IfAbsent  bool        `json:"if_absent,omitempty"`  // key must not exist
+	IfPresent bool        `json:"if_present,omitempty"` // key must exist
+	// IfHashIn, when not nil, lists the hashes the current value may have,
+	// from the strong ETags of an If-Match header. Empty never matches.
+	IfHashIn []string `json:"-"`
+}
+
+// Empty reports whether no predicate is set. A put with an empty condition
+// is refused rather than applied unconditionally.
+func (c Condition) Empty() bool {
+	return c.IfHash == "" && c.IfVersion == nil && !c.IfAbsent && !c.IfPresent && c.IfHashIn == nil
+}
+
+// Holds reports whether the condition is satisfied by the stored siblings.
+func (c Condition) Holds(siblings []Versioned) bool {
+	if c.IfAbsent && len(siblings) > 0 {
+		return false
+	}
+	if c.IfPresent && len(siblings) == 0 {
+		return false
+	}
+	if c.IfVersion != nil && c.IfVersion.Compare(MergedClock(siblings)) != Equal {
+		return false
+	}
+	if c.IfHash != "" {
+		// A hash can only match a single, non-conflicting value
+		if len(siblings) != 1 || HashValue(siblings[0].Value) != c.IfHash {
+			return false
+		}
+	}
+	if c.IfHashIn != nil {
+		if len(siblings) != 1 || !slices.Contains(c.IfHashIn, HashValue(siblings[0].Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// HashValue returns the hex SHA-1 of a value, as used by Condition.IfHash.
+func HashValue(value []byte) string {
+	h := sha1.Sum(value)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,56 @@
+package version
+
+import "testing"
+
+func TestConditionHolds(t *testing.T) {
+	one := []Versioned{{Value: []byte("x"), Clock: VectorClock{"a": 1}}}
+	two := []Versioned{{Value: []byte("x"), Clock: VectorClock{"a": 1}}, {Value: []byte("y"), Clock: VectorClock{"b": 1}}}
+	tests := []struct {
+		name     string
+		cond     Condition
+		siblings []Versioned
+		want     bool
+	}{
+		{"if_absent, missing", Condition{IfAbsent: true}, nil, true},
+		{"if_absent, present", Condition{IfAbsent: true}, one, false},
+		{"if_present, present", Condition{IfPresent: true}, one, true},
+		{"if_present, missing", Condition{IfPresent: true}, nil, false},
+		{"if_version, current", Condition{IfVersion: VectorClock{"a": 1}}, one, true},
+		{"if_version, stale", Condition{IfVersion: VectorClock{}}, one, false},
+		{"if_version, newer", Condition{IfVersion: VectorClock{"a": 2}}, one, false},
+		{"if_version {}, missing", Condition{IfVersion: VectorClock{}}, nil, true},
+		{"if_version, merge of siblings", Condition{IfVersion: VectorClock{"a": 1, "b": 1}}, two, true},
+		{"if_hash, matching", Condition{IfHash: HashValue([]byte("x"))}, one, true},
+		{"if_hash, other value", Condition{IfHash: HashValue([]byte("y"))}, one, false},
+		{"if_hash, missing", Condition{IfHash: HashValue([]byte("x"))}, nil, false},
+		{"if_hash, siblings", Condition{IfHash: HashValue([]byte("x"))}, two, false},
+		{"if_hash_in, listed", Condition{IfHashIn: []string{HashValue([]byte("y")), HashValue([]byte("x"))}}, one, true},
+		{"if_hash_in, not listed", Condition{IfHashIn: []string{HashValue([]byte("y"))}}, one, false},
+		{"if_hash_in, empty", Condition{IfHashIn: []string{}}, one, false},
+		{"all hold", Condition{IfPresent: true, IfVersion: VectorClock{"a": 1}, IfHash: HashValue([]byte("x"))}, one, true},
+		{"one fails", Condition{IfPresent: true, IfVersion: VectorClock{"a": 1}, IfHash: HashValue([]byte("y"))}, one, false},
+	}
+	for _, tt := range tests {
+		if got := tt.cond.Holds(tt.siblings); got != tt.want {
+			t.Errorf("%s: Holds = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConditionEmpty(t *testing.T) {
+	tests := []struct {
+		cond Condition
+		want bool
+	}{
+		{Condition{}, true},
+		{Condition{IfVersion: VectorClock{}}, false},
+		{Condition{IfHashIn: []string{}}, false},
+		{Condition{IfAbsent: true}, false},
+		{Condition{IfHash: HashValue(nil)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.cond.Empty(); got != tt.want {
+			t.Errorf("%+v.Empty() = %v, want %v", tt.cond, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module dht-version
+
+go 1.24.3
@@ -0,0 +1,103 @@
+// Package version holds the vector clocks and sibling values behind
+// versioned and conditional puts. It is shared by dht-node and dht-server.
+package version
+
+// VectorClock tracks the causal history of a value as a per-node write counter.
+type VectorClock map[string]uint64
+
+// Ordering describes how two vector clocks relate to each other.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// Versioned is a single stored value together with its vector clock.
+// A key holds more than one Versioned (siblings) when writes conflict.
+type Versioned struct {
+	Value       []byte      `json:"value"` // base64 encoded in JSON
+	ContentType string      `json:"content_type,omitempty"`
+	Clock       VectorClock `json:"clock"`
+}
+
+// Copy returns an independent copy of the clock.
+func (vc VectorClock) Copy() VectorClock {
+	c := make(VectorClock, len(vc))
+	for k, v := range vc {
+		c[k] = v
+	}
+	return c
+}
+
+// Increment returns a copy of the clock with nodeID's counter bumped by one.
+func (vc VectorClock) Increment(nodeID string) VectorClock {
+	c := vc.Copy()
+	c[nodeID]++
+	return c
+}
+
+// Merge returns the element-wise maximum of both clocks.
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	c := vc.Copy()
+	for k, v := range other {
+		if v > c[k] {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// Compare reports whether vc happened before, after, equal to, or
+// concurrently with other.
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for k, v := range vc {
+		if v > other[k] {
+			greater = true
+		} else if v < other[k] {
+			less = true
+		}
+	}
+	for k, v := range other {
+		if _, ok := vc[k]; !ok && v > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// MergedClock returns the merge of all sibling clocks, the version of a key.
+func MergedClock(siblings []Versioned) VectorClock {
+	vc := VectorClock{}
+	for _, s := range siblings {
+		vc = vc.Merge(s.Clock)
+	}
+	return vc
+}
+
+// Reconcile adds v to the sibling set, dropping any sibling it descends from.
+// If v is already covered by an existing sibling, the set is returned unchanged.
+func Reconcile(siblings []Versioned, v Versioned) []Versioned {
+	result := make([]Versioned, 0, len(siblings)+1)
+	for _, s := range siblings {
+		switch s.Clock.Compare(v.Clock) {
+		case Equal, After:
+			return siblings
+		case Concurrent:
+			result = append(result, s)
+		}
+	}
+	return append(result, v)
+}
@@ -0,0 +1,83 @@
+package version
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b VectorClock
+		want Ordering
+	}{
+		{nil, nil, Equal},
+		{VectorClock{}, nil, Equal},
+		{VectorClock{"a": 1}, VectorClock{"a": 1}, Equal},
+		{VectorClock{"a": 0}, VectorClock{}, Equal},
+		{VectorClock{}, VectorClock{"a": 1}, Before},
+		{VectorClock{"a": 1}, VectorClock{"a": 2}, Before},
+		{VectorClock{"a": 1}, VectorClock{"a": 1, "b": 1}, Before},
+		{VectorClock{"a": 2}, VectorClock{"a": 1}, After},
+		{VectorClock{"a": 1, "b": 1}, VectorClock{"b": 1}, After},
+		{VectorClock{"a": 1}, VectorClock{"b": 1}, Concurrent},
+		{VectorClock{"a": 2, "b": 1}, VectorClock{"a": 1, "b": 2}, Concurrent},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Compare(tt.b); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMergeIncrement(t *testing.T) {
+	a := VectorClock{"a": 2, "b": 1}
+	merged := a.Merge(VectorClock{"b": 3, "c": 1})
+	if want := (VectorClock{"a": 2, "b": 3, "c": 1}); merged.Compare(want) != Equal {
+		t.Errorf("Merge = %v, want %v", merged, want)
+	}
+	if next := merged.Increment("a"); next["a"] != 3 || merged["a"] != 2 {
+		t.Errorf("Increment = %v from %v, want a copy with a at 3", next, merged)
+	}
+	if a["b"] != 1 {
+		t.Errorf("Merge changed its receiver to %v", a)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	v := func(value string, clock VectorClock) Versioned {
+		return Versioned{Value: []byte(value), Clock: clock}
+	}
+	tests := []struct {
+		name     string
+		siblings []Versioned
+		add      Versioned
+		want     []string // values left, in order
+	}{
+		{"first value", nil, v("x", VectorClock{"a": 1}), []string{"x"}},
+		{"descendant replaces", []Versioned{v("x", VectorClock{"a": 1})}, v("y", VectorClock{"a": 2}), []string{"y"}},
+		{"older is ignored", []Versioned{v("x", VectorClock{"a": 2})}, v("y", VectorClock{"a": 1}), []string{"x"}},
+		{"equal is ignored", []Versioned{v("x", VectorClock{"a": 1})}, v("y", VectorClock{"a": 1}), []string{"x"}},
+		{"concurrent is kept", []Versioned{v("x", VectorClock{"a": 1})}, v("y", VectorClock{"b": 1}), []string{"x", "y"}},
+		{
+			"resolving write replaces both siblings",
+			[]Versioned{v("x", VectorClock{"a": 1}), v("y", VectorClock{"b": 1})},
+			v("z", VectorClock{"a": 1, "b": 1, "c": 1}),
+			[]string{"z"},
+		},
+		{
+			"replaces only the sibling it descends from",
+			[]Versioned{v("x", VectorClock{"a": 1}), v("y", VectorClock{"b": 1})},
+			v("z", VectorClock{"a": 2}),
+			[]string{"y", "z"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, s := range Reconcile(tt.siblings, tt.add) {
+			got = append(got, string(s.Value))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Reconcile = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}